@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+type adminGetPaymentsResponse struct {
+	Payments []adminGetPaymentsResponsePayment `json:"payments"`
+}
+
+type adminGetPaymentsResponsePayment struct {
+	RideID        string  `json:"ride_id"`
+	UserID        string  `json:"user_id"`
+	Amount        int     `json:"amount"`
+	Status        string  `json:"status"`
+	Attempts      int     `json:"attempts"`
+	LastError     *string `json:"last_error,omitempty"`
+	NextAttemptAt *int64  `json:"next_attempt_at,omitempty"`
+	CreatedAt     int64   `json:"created_at"`
+	UpdatedAt     int64   `json:"updated_at"`
+}
+
+func adminGetPayments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "PENDING" && status != "SUCCEEDED" && status != "FAILED" {
+		writeError(w, http.StatusBadRequest, errors.New("status must be one of PENDING, SUCCEEDED, FAILED"))
+		return
+	}
+
+	payments := []PaymentOutbox{}
+	if status == "" {
+		if err := db.SelectContext(ctx, &payments, "SELECT * FROM payment_outbox ORDER BY created_at DESC"); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		if err := db.SelectContext(ctx, &payments, "SELECT * FROM payment_outbox WHERE status = ? ORDER BY created_at DESC", status); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	res := adminGetPaymentsResponse{Payments: []adminGetPaymentsResponsePayment{}}
+	for _, payment := range payments {
+		p := adminGetPaymentsResponsePayment{
+			RideID:    payment.RideID,
+			UserID:    payment.UserID,
+			Amount:    payment.Amount,
+			Status:    payment.Status,
+			Attempts:  payment.Attempts,
+			CreatedAt: payment.CreatedAt.UnixMilli(),
+			UpdatedAt: payment.UpdatedAt.UnixMilli(),
+		}
+		if payment.LastError.Valid {
+			p.LastError = &payment.LastError.String
+		}
+		// 次の送信予定は送信待ちのときだけ意味がある
+		if payment.Status == "PENDING" {
+			t := payment.NextAttemptAt.UnixMilli()
+			p.NextAttemptAt = &t
+		}
+		res.Payments = append(res.Payments, p)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func adminPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	handlePostRideRefund(w, r, "admin", func(ride *Ride) error {
+		return nil
+	})
+}
+
+// 初回登録と招待のクーポンはアプリが発行するので、キャンペーンには使えない
+var reservedCouponCodePrefixes = []string{"CP_NEW2024", "INV_", "RWD_"}
+
+type adminPostCampaignsRequest struct {
+	Code     string `json:"code"`
+	Discount int    `json:"discount"`
+	// AMOUNT, PERCENT, WAIVE_INITIAL_FARE のいずれか。省略した場合は AMOUNT
+	DiscountKind string `json:"discount_kind"`
+	// PERCENT のときの割引額の上限
+	DiscountCap *int `json:"discount_cap"`
+	// 省略した場合は期間の制限なし
+	StartsAt  *int64 `json:"starts_at"`
+	ExpiresAt *int64 `json:"expires_at"`
+	// 省略した場合は誰にでも付与できる
+	TargetUserIDs []string `json:"target_user_ids"`
+}
+
+type adminCampaignResponse struct {
+	Code          string `json:"code"`
+	Discount      int    `json:"discount"`
+	DiscountKind  string `json:"discount_kind"`
+	DiscountCap   *int   `json:"discount_cap,omitempty"`
+	StartsAt      *int64 `json:"starts_at,omitempty"`
+	ExpiresAt     *int64 `json:"expires_at,omitempty"`
+	TargetCount   int    `json:"target_count"`
+	GrantedCount  int    `json:"granted_count"`
+	RedeemedCount int    `json:"redeemed_count"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+type campaignWithStats struct {
+	CouponCampaign
+	TargetCount   int `db:"target_count"`
+	GrantedCount  int `db:"granted_count"`
+	RedeemedCount int `db:"redeemed_count"`
+}
+
+// 使用中のクーポンも利用回数に数える。キャンセルされたライドのクーポンは未使用に戻るので数えない
+const selectCampaignsWithStatsQuery = `
+	SELECT coupon_campaigns.*,
+	       (SELECT COUNT(*) FROM coupon_campaign_targets WHERE code = coupon_campaigns.code) AS target_count,
+	       (SELECT COUNT(*) FROM coupons WHERE code = coupon_campaigns.code) AS granted_count,
+	       (SELECT COUNT(*) FROM coupons WHERE code = coupon_campaigns.code AND used_by IS NOT NULL) AS redeemed_count
+	FROM coupon_campaigns
+`
+
+func newAdminCampaignResponse(c *campaignWithStats) adminCampaignResponse {
+	res := adminCampaignResponse{
+		Code:          c.Code,
+		Discount:      c.Discount,
+		DiscountKind:  c.DiscountKind,
+		TargetCount:   c.TargetCount,
+		GrantedCount:  c.GrantedCount,
+		RedeemedCount: c.RedeemedCount,
+		CreatedAt:     c.CreatedAt.UnixMilli(),
+	}
+	if c.DiscountCap.Valid {
+		discountCap := int(c.DiscountCap.Int64)
+		res.DiscountCap = &discountCap
+	}
+	if c.StartsAt.Valid {
+		t := c.StartsAt.Time.UnixMilli()
+		res.StartsAt = &t
+	}
+	if c.ExpiresAt.Valid {
+		t := c.ExpiresAt.Time.UnixMilli()
+		res.ExpiresAt = &t
+	}
+	return res
+}
+
+func adminPostCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &adminPostCampaignsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Code == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(code) are empty"))
+		return
+	}
+	for _, prefix := range reservedCouponCodePrefixes {
+		if strings.HasPrefix(req.Code, prefix) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("code must not start with %s", prefix))
+			return
+		}
+	}
+	if req.DiscountKind == "" {
+		req.DiscountKind = couponKindAmount
+	}
+	if !isValidCouponKind(req.DiscountKind) {
+		writeError(w, http.StatusBadRequest, errors.New("discount_kind must be one of AMOUNT, PERCENT, WAIVE_INITIAL_FARE"))
+		return
+	}
+	switch req.DiscountKind {
+	case couponKindAmount:
+		if req.Discount <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("discount must be positive"))
+			return
+		}
+	case couponKindPercent:
+		if req.Discount <= 0 || req.Discount > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("discount must be between 1 and 100 for PERCENT"))
+			return
+		}
+	case couponKindWaiveInitialFare:
+		// 割引額は初乗り運賃で決まる
+		req.Discount = 0
+	}
+	if req.DiscountCap != nil && (req.DiscountKind != couponKindPercent || *req.DiscountCap <= 0) {
+		writeError(w, http.StatusBadRequest, errors.New("discount_cap must be positive and only for PERCENT"))
+		return
+	}
+	if req.StartsAt != nil && req.ExpiresAt != nil && *req.ExpiresAt <= *req.StartsAt {
+		writeError(w, http.StatusBadRequest, errors.New("expires_at must be after starts_at"))
+		return
+	}
+
+	var discountCap sql.NullInt64
+	if req.DiscountCap != nil {
+		discountCap = sql.NullInt64{Int64: int64(*req.DiscountCap), Valid: true}
+	}
+	var startsAt, expiresAt sql.NullTime
+	if req.StartsAt != nil {
+		startsAt = sql.NullTime{Time: time.UnixMilli(*req.StartsAt), Valid: true}
+	}
+	if req.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: time.UnixMilli(*req.ExpiresAt), Valid: true}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 付与済みのクーポンとコードが重なると、利用回数が混ざってしまう
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM coupon_campaigns WHERE code = ?) OR EXISTS(SELECT 1 FROM coupons WHERE code = ?)", req.Code, req.Code); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if exists {
+		writeError(w, http.StatusConflict, errors.New("code is already used"))
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO coupon_campaigns (code, discount, discount_kind, discount_cap, starts_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		req.Code, req.Discount, req.DiscountKind, discountCap, startsAt, expiresAt,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, userID := range lo.Uniq(req.TargetUserIDs) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO coupon_campaign_targets (code, user_id) VALUES (?, ?)", req.Code, userID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	campaign := &campaignWithStats{}
+	if err := tx.GetContext(ctx, campaign, selectCampaignsWithStatsQuery+" WHERE code = ?", req.Code); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAdminCampaignResponse(campaign))
+}
+
+type adminGetCampaignsResponse struct {
+	Campaigns []adminCampaignResponse `json:"campaigns"`
+}
+
+func adminGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	campaigns := []campaignWithStats{}
+	if err := db.SelectContext(ctx, &campaigns, selectCampaignsWithStatsQuery+" ORDER BY created_at DESC"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := adminGetCampaignsResponse{Campaigns: []adminCampaignResponse{}}
+	for _, campaign := range campaigns {
+		res.Campaigns = append(res.Campaigns, newAdminCampaignResponse(&campaign))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type adminPostCampaignGrantsRequest struct {
+	// 付与対象が決まっているキャンペーンでは、省略すると対象者全員に付与する
+	UserIDs []string `json:"user_ids"`
+}
+
+type adminPostCampaignGrantsResponse struct {
+	Granted int `json:"granted"`
+	// 存在しないユーザー、付与対象外のユーザー、付与済みのユーザーの数
+	Skipped int `json:"skipped"`
+}
+
+func adminPostCampaignGrants(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code := r.PathValue("code")
+	req := &adminPostCampaignGrantsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	campaign := &CouponCampaign{}
+	if err := tx.GetContext(ctx, campaign, "SELECT * FROM coupon_campaigns WHERE code = ? FOR UPDATE", code); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("campaign not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var expired bool
+	if err := tx.GetContext(ctx, &expired, "SELECT ? IS NOT NULL AND ? <= CURRENT_TIMESTAMP(6)", campaign.ExpiresAt, campaign.ExpiresAt); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if expired {
+		writeError(w, http.StatusBadRequest, errors.New("campaign has expired"))
+		return
+	}
+
+	targets := []string{}
+	if err := tx.SelectContext(ctx, &targets, "SELECT user_id FROM coupon_campaign_targets WHERE code = ?", code); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	userIDs := lo.Uniq(req.UserIDs)
+	if len(userIDs) == 0 {
+		if len(targets) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("required fields(user_ids) are empty"))
+			return
+		}
+		userIDs = targets
+	}
+
+	res := adminPostCampaignGrantsResponse{}
+	for _, userID := range userIDs {
+		if len(targets) > 0 && !lo.Contains(targets, userID) {
+			res.Skipped++
+			continue
+		}
+		result, err := tx.ExecContext(
+			ctx,
+			"INSERT IGNORE INTO coupons (user_id, code, discount, discount_kind, discount_cap, starts_at, expires_at) SELECT id, ?, ?, ?, ?, ?, ? FROM users WHERE id = ?",
+			campaign.Code, campaign.Discount, campaign.DiscountKind, campaign.DiscountCap, campaign.StartsAt, campaign.ExpiresAt, userID,
+		)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if count == 0 {
+			res.Skipped++
+			continue
+		}
+		res.Granted++
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
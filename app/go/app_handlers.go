@@ -5,7 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -71,6 +74,12 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 
 	// 招待コードを使った登録
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
+		rules, err := getInvitationRules(ctx, tx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
 		// 招待する側の招待数をチェック
 		var coupons []Coupon
 		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
@@ -78,7 +87,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if len(coupons) >= 3 {
+		if rules.MaxUses > 0 && len(coupons) >= rules.MaxUses {
 			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
 			return
 		}
@@ -99,7 +108,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		_, err = tx.ExecContext(
 			ctx,
 			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
+			userID, "INV_"+*req.InvitationCode, rules.InviteeDiscount,
 		)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
@@ -109,7 +118,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		_, err = tx.ExecContext(
 			ctx,
 			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
+			inviter.ID, "RWD_"+*req.InvitationCode, rules.InviterReward,
 		)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
@@ -134,6 +143,70 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type appGetInvitationsResponse struct {
+	InvitationCode string `json:"invitation_code"`
+	// 招待コードが使われた回数
+	UsedCount int `json:"used_count"`
+	// 招待コードを使える回数。0 なら無制限
+	MaxUses         int `json:"max_uses"`
+	InviteeDiscount int `json:"invitee_discount"`
+	InviterReward   int `json:"inviter_reward"`
+	// 招待で獲得したクーポン。獲得した順に並べる
+	Rewards []appGetInvitationsResponseReward `json:"rewards"`
+}
+
+type appGetInvitationsResponseReward struct {
+	Code      string  `json:"code"`
+	Discount  int     `json:"discount"`
+	GrantedAt int64   `json:"granted_at"`
+	Used      bool    `json:"used"`
+	RideID    *string `json:"ride_id,omitempty"`
+}
+
+func appGetInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	rules, err := getInvitationRules(ctx, db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var usedCount int
+	if err := db.GetContext(ctx, &usedCount, "SELECT COUNT(*) FROM coupons WHERE code = ?", "INV_"+user.InvitationCode); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 招待した人のクーポンは RWD_<招待コード>_<付与時刻> で付与している
+	rewards := []Coupon{}
+	if err := db.SelectContext(ctx, &rewards, `SELECT * FROM coupons WHERE user_id = ? AND code LIKE CONCAT('RWD\_', ?, '\_%') ORDER BY created_at`, user.ID, user.InvitationCode); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &appGetInvitationsResponse{
+		InvitationCode:  user.InvitationCode,
+		UsedCount:       usedCount,
+		MaxUses:         rules.MaxUses,
+		InviteeDiscount: rules.InviteeDiscount,
+		InviterReward:   rules.InviterReward,
+		Rewards:         []appGetInvitationsResponseReward{},
+	}
+	for _, reward := range rewards {
+		res.Rewards = append(res.Rewards, appGetInvitationsResponseReward{
+			Code:      reward.Code,
+			Discount:  reward.Discount,
+			GrantedAt: reward.CreatedAt.UnixMilli(),
+			Used:      reward.UsedBy != nil,
+			RideID:    reward.UsedBy,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
 type appPostPaymentMethodsRequest struct {
 	Token string `json:"token"`
 }
@@ -221,17 +294,11 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
 			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
 			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
+			Fare:                  ride.Fare,
 			Evaluation:            *ride.Evaluation,
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
 			CompletedAt:           ride.UpdatedAt.UnixMilli(),
@@ -271,11 +338,15 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 省略した場合はクーポンを自動で選ぶ
+	CouponCode *string `json:"coupon_code"`
 }
 
 type appPostRidesResponse struct {
 	RideID string `json:"ride_id"`
 	Fare   int    `json:"fare"`
+	// 配車要求の時点で確定した運賃の倍率
+	SurgeMultiplier float64 `json:"surge_multiplier"`
 }
 
 type executableGet interface {
@@ -306,6 +377,9 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
 
+	// 倍率は配車要求の時点で確定させ、以降の運賃はライドに記録した倍率で計算する
+	surgeMultiplier := getSurgeMultiplier(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+
 	tx, err := db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -326,7 +400,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "COMPLETED" {
+		if !isRideFinished(status) {
 			continuingRideCount++
 		}
 	}
@@ -336,22 +410,33 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 指定されたクーポンは持っていて未使用のものに限る
+	var selectedCoupon *Coupon
+	if req.CouponCode != nil && *req.CouponCode != "" {
+		selectedCoupon, err = getAvailableCoupon(ctx, tx, user.ID, *req.CouponCode)
+		if err != nil {
+			if errors.Is(err, errCouponNotAvailable) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, surge_multiplier)
+				  VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, surgeMultiplier,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	matchingEvent, err := insertRideStatus(ctx, tx, &Ride{ID: rideID, UserID: user.ID}, "", "MATCHING", rideActorApp)
+	if err != nil {
+		writeRideStatusError(w, err)
 		return
 	}
 
@@ -362,16 +447,25 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var coupon Coupon
-	if rideCount == 1 {
+	if selectedCoupon != nil {
+		if _, err := tx.ExecContext(
+			ctx,
+			"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
+			rideID, user.ID, selectedCoupon.Code,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else if rideCount == 1 {
 		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND "+couponAvailableCondition+" FOR UPDATE", user.ID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
 
 			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND "+couponAvailableCondition+" ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
 				if !errors.Is(err, sql.ErrNoRows) {
 					writeError(w, http.StatusInternalServerError, err)
 					return
@@ -398,7 +492,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND "+couponAvailableCondition+" ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusInternalServerError, err)
 				return
@@ -421,31 +515,47 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	// 運賃は配車要求の時点で確定させ、以降はライドに記録した内訳を使う
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, "", ride.SurgeMultiplier, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE rides SET base_fare = ?, metered_fare = ?, discount = ?, fare = ? WHERE id = ?",
+		fare.BaseFare, fare.MeteredFare, fare.Discount, fare.Fare, rideID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	publishRideStatusEvents(matchingEvent)
+
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
-		RideID: rideID,
-		Fare:   fare,
+		RideID:          rideID,
+		Fare:            fare.Fare,
+		SurgeMultiplier: float64(ride.SurgeMultiplier) / surgeBaseMultiplier,
 	})
 }
 
 type appPostRidesEstimatedFareRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 省略した場合はクーポンを自動で選ぶ
+	CouponCode *string `json:"coupon_code"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
 	Fare     int `json:"fare"`
 	Discount int `json:"discount"`
+	// 配車位置周辺の混雑による運賃の倍率
+	SurgeMultiplier float64 `json:"surge_multiplier"`
 }
 
 func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -462,6 +572,8 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 
 	user := ctx.Value("user").(*User)
 
+	surgeMultiplier := getSurgeMultiplier(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+
 	tx, err := db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -469,8 +581,16 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	couponCode := ""
+	if req.CouponCode != nil {
+		couponCode = *req.CouponCode
+	}
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, nil, couponCode, surgeMultiplier, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
 	if err != nil {
+		if errors.Is(err, errCouponNotAvailable) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -481,11 +601,99 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Fare:            fare.Fare,
+		Discount:        fare.Discount,
+		SurgeMultiplier: float64(surgeMultiplier) / surgeBaseMultiplier,
 	})
 }
 
+type appGetCouponsResponse struct {
+	// 今使えるクーポン。自動で選ばれる順に並べる
+	Available []appGetCouponsResponseCoupon `json:"available"`
+	// 使用済みのクーポン。新しいライドのものから並べる
+	Used []appGetCouponsResponseCoupon `json:"used"`
+}
+
+type appGetCouponsResponseCoupon struct {
+	Code         string  `json:"code"`
+	Discount     int     `json:"discount"`
+	DiscountKind string  `json:"discount_kind"`
+	DiscountCap  *int    `json:"discount_cap,omitempty"`
+	StartsAt     *int64  `json:"starts_at,omitempty"`
+	ExpiresAt    *int64  `json:"expires_at,omitempty"`
+	GrantedAt    int64   `json:"granted_at"`
+	RideID       *string `json:"ride_id,omitempty"`
+}
+
+type couponWithAvailability struct {
+	Coupon
+	Available bool `db:"available"`
+}
+
+// 期限切れや利用開始前の未使用クーポンはどちらにも含めない
+func appGetCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	coupons := []couponWithAvailability{}
+	if err := db.SelectContext(
+		ctx,
+		&coupons,
+		"SELECT *, "+couponAvailableCondition+" AS available FROM coupons WHERE user_id = ? ORDER BY code = 'CP_NEW2024' DESC, created_at",
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &appGetCouponsResponse{
+		Available: []appGetCouponsResponseCoupon{},
+		Used:      []appGetCouponsResponseCoupon{},
+	}
+	for _, coupon := range coupons {
+		item := appGetCouponsResponseCoupon{
+			Code:         coupon.Code,
+			Discount:     coupon.Discount,
+			DiscountKind: coupon.DiscountKind,
+			GrantedAt:    coupon.CreatedAt.UnixMilli(),
+			RideID:       coupon.UsedBy,
+		}
+		if coupon.DiscountCap.Valid {
+			discountCap := int(coupon.DiscountCap.Int64)
+			item.DiscountCap = &discountCap
+		}
+		if coupon.StartsAt.Valid {
+			t := coupon.StartsAt.Time.UnixMilli()
+			item.StartsAt = &t
+		}
+		if coupon.ExpiresAt.Valid {
+			t := coupon.ExpiresAt.Time.UnixMilli()
+			item.ExpiresAt = &t
+		}
+
+		if coupon.UsedBy != nil {
+			res.Used = append(res.Used, item)
+		} else if coupon.Available {
+			res.Available = append(res.Available, item)
+		}
+	}
+	// ライドIDは ULID なので、降順に並べると新しいライドが先になる
+	slices.SortFunc(res.Used, func(a, b appGetCouponsResponseCoupon) int {
+		return strings.Compare(*b.RideID, *a.RideID)
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 椅子が座標を送る間隔。椅子は1回送るごとに最大でモデルの速さの分だけ進む
+const chairCoordinateInterval = 1 * time.Second
+
+// distance だけ離れた位置に着くまでに、speed の椅子が座標を送る回数
+func calculateArrivalMoves(distance, speed int) int {
+	speed = max(speed, 1)
+	return (distance + speed - 1) / speed
+}
+
 // マンハッタン距離を求める
 func calculateDistance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
 	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
@@ -541,8 +749,9 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if status != "ARRIVED" {
-		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+	completedEvent, err := insertRideStatus(ctx, tx, ride, status, "COMPLETED", rideActorApp)
+	if err != nil {
+		writeRideStatusError(w, err)
 		return
 	}
 
@@ -562,15 +771,6 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
@@ -590,32 +790,18 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
+	// 決済はコミット後にワーカーが行う
+	if err := enqueuePayment(ctx, tx, ride, ride.Fare); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
-	}
 
-	var paymentGatewayURL string
-	if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+	if err := recordRideLedger(ctx, tx, ride); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
-			return nil, err
-		}
-		return rides, nil
-	}); err != nil {
-		if errors.Is(err, erroredUpstream) {
-			writeError(w, http.StatusBadGateway, err)
-			return
-		}
+	if err := recordChairSalesAggregate(ctx, tx, ride); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -625,6 +811,9 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publishRideStatusEvents(completedEvent)
+	wakePaymentJobWorker()
+
 	activeRides, err := cache.activeRides.Get(ctx, ride.ChairID.String)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -637,6 +826,24 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	if _, err := cancelRide(ctx, rideID, rideActorApp, func(ride *Ride) error {
+		if ride.UserID != user.ID {
+			return errRideNotFound
+		}
+		return nil
+	}); err != nil {
+		writeCancelRideError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type appGetNotificationResponse struct {
 	Data         *appGetNotificationResponseData `json:"data"`
 	RetryAfterMs int                             `json:"retry_after_ms"`
@@ -669,23 +876,40 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	tx, err := db.Beginx()
+	if acceptsEventStream(r) {
+		serveNotificationStream(w, r, isUserRideEvent(user.ID), func(ctx context.Context) (*appGetNotificationResponseData, bool, error) {
+			return getAppNotification(ctx, user)
+		})
+		return
+	}
+
+	data, _, err := getAppNotification(ctx, user)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+
+	writeJSON(w, http.StatusOK, &appGetNotificationResponse{
+		Data:         data,
+		RetryAfterMs: 1000,
+	})
+}
+
+// 未送信のステータスがあれば最も古いものを送信済みにして返し、無ければ最新のステータスを返す
+// 未送信のステータスを返したかどうかを2つ目の戻り値で返す
+func getAppNotification(ctx context.Context, user *User) (*appGetNotificationResponseData, bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, false, err
+	}
 	defer tx.Rollback()
 
 	ride := &Ride{}
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
-				RetryAfterMs: 1000,
-			})
-			return
+			return nil, false, nil
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
 	yetSentRideStatus := RideStatus{}
@@ -694,56 +918,43 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		if errors.Is(err, sql.ErrNoRows) {
 			status, err = getLatestRideStatus(ctx, tx, ride.ID)
 			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, false, err
 			}
 		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, false, err
 		}
 	} else {
 		status = yetSentRideStatus.Status
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	response := &appGetNotificationResponse{
-		Data: &appGetNotificationResponseData{
-			RideID: ride.ID,
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Fare:      fare,
-			Status:    status,
-			CreatedAt: ride.CreatedAt.UnixMilli(),
-			UpdateAt:  ride.UpdatedAt.UnixMilli(),
+	data := &appGetNotificationResponseData{
+		RideID: ride.ID,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
 		},
-		RetryAfterMs: 1000,
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Fare:      ride.Fare,
+		Status:    status,
+		CreatedAt: ride.CreatedAt.UnixMilli(),
+		UpdateAt:  ride.UpdatedAt.UnixMilli(),
 	}
 
 	if ride.ChairID.Valid {
 		chair := &Chair{}
 		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, false, err
 		}
 
 		stats, err := getChairStats(ctx, tx, chair.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, false, err
 		}
 
-		response.Data.Chair = &appGetNotificationResponseChair{
+		data.Chair = &appGetNotificationResponseChair{
 			ID:    chair.ID,
 			Name:  chair.Name,
 			Model: chair.Model,
@@ -754,17 +965,15 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	if yetSentRideStatus.ID != "" {
 		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, false, err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
-	writeJSON(w, http.StatusOK, response)
+	return data, yetSentRideStatus.ID != "", nil
 }
 
 func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
@@ -836,6 +1045,9 @@ type appGetNearbyChairsResponseChair struct {
 	Name              string     `json:"name"`
 	Model             string     `json:"model"`
 	CurrentCoordinate Coordinate `json:"current_coordinate"`
+	Distance          int        `json:"distance"`
+	// 配車位置に到着するまでの見込み時間 (ミリ秒)
+	EstimatedArrivalTime int64 `json:"estimated_arrival_time"`
 }
 
 func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
@@ -869,6 +1081,36 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	minSpeed := 0
+	if s := r.URL.Query().Get("min_speed"); s != "" {
+		minSpeed, err = strconv.Atoi(s)
+		if err != nil || minSpeed < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("min_speed is invalid"))
+			return
+		}
+	}
+
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit is invalid"))
+			return
+		}
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy != "" && sortBy != "distance" && sortBy != "eta" {
+		writeError(w, http.StatusBadRequest, errors.New("sort must be one of distance, eta"))
+		return
+	}
+
+	// model は複数指定でき、いずれかに一致する椅子を返す
+	models := map[string]bool{}
+	for _, model := range r.URL.Query()["model"] {
+		models[model] = true
+	}
+
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
 
 	tx, err := db.Beginx()
@@ -878,22 +1120,51 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	// 索引から距離内にいる椅子を探し、その椅子だけを DB から読む
+	positions := cache.chairGrid.Within(coordinate, distance)
+	chairIDs := make([]string, 0, len(positions))
+	for _, p := range positions {
+		chairIDs = append(chairIDs, p.ChairID)
+	}
 	chairs := []Chair{}
-	err = tx.SelectContext(
-		ctx,
-		&chairs,
-		`SELECT * FROM chairs`,
-	)
-	if err != nil {
+	if len(chairIDs) > 0 {
+		query, args, err := sqlx.In(`SELECT * FROM chairs WHERE id IN (?) ORDER BY id`, chairIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.SelectContext(ctx, &chairs, tx.Rebind(query), args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	positionByChairID := make(map[string]Coordinate, len(positions))
+	for _, p := range positions {
+		positionByChairID[p.ChairID] = p.Coordinate
+	}
+
+	chairModels := []ChairModel{}
+	if err := tx.SelectContext(ctx, &chairModels, `SELECT * FROM chair_models`); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	speedByModel := make(map[string]int, len(chairModels))
+	for _, model := range chairModels {
+		speedByModel[model.Name] = model.Speed
+	}
 
 	nearbyChairs := []appGetNearbyChairsResponseChair{}
 	for _, chair := range chairs {
 		if !chair.IsActive {
 			continue
 		}
+		if len(models) > 0 && !models[chair.Model] {
+			continue
+		}
+		speed := speedByModel[chair.Model]
+		if speed < minSpeed {
+			continue
+		}
 
 		activeRides, err := cache.activeRides.Get(ctx, chair.ID)
 		if err != nil {
@@ -904,24 +1175,34 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		// 最新の位置情報を取得
-		maybeChairLocation, _ := cache.latestChairLocation.Get(ctx, chair.ID)
-		if !maybeChairLocation.Found {
-			continue
-		}
-		chairLocation := maybeChairLocation.Value
-
-		if calculateDistance(coordinate.Latitude, coordinate.Longitude, chairLocation.Latitude, chairLocation.Longitude) <= distance {
-			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
-				ID:    chair.ID,
-				Name:  chair.Name,
-				Model: chair.Model,
-				CurrentCoordinate: Coordinate{
-					Latitude:  chairLocation.Latitude,
-					Longitude: chairLocation.Longitude,
-				},
-			})
-		}
+		chairCoordinate := positionByChairID[chair.ID]
+		chairDistance := calculateDistance(coordinate.Latitude, coordinate.Longitude, chairCoordinate.Latitude, chairCoordinate.Longitude)
+		nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
+			ID:                   chair.ID,
+			Name:                 chair.Name,
+			Model:                chair.Model,
+			CurrentCoordinate:    chairCoordinate,
+			Distance:             chairDistance,
+			EstimatedArrivalTime: (time.Duration(calculateArrivalMoves(chairDistance, speed)) * chairCoordinateInterval).Milliseconds(),
+		})
+	}
+
+	// 指定が無ければ椅子ID順のまま返す
+	switch sortBy {
+	case "distance":
+		sort.SliceStable(nearbyChairs, func(i, j int) bool {
+			return nearbyChairs[i].Distance < nearbyChairs[j].Distance
+		})
+	case "eta":
+		sort.SliceStable(nearbyChairs, func(i, j int) bool {
+			if nearbyChairs[i].EstimatedArrivalTime != nearbyChairs[j].EstimatedArrivalTime {
+				return nearbyChairs[i].EstimatedArrivalTime < nearbyChairs[j].EstimatedArrivalTime
+			}
+			return nearbyChairs[i].Distance < nearbyChairs[j].Distance
+		})
+	}
+	if limit > 0 && len(nearbyChairs) > limit {
+		nearbyChairs = nearbyChairs[:limit]
 	}
 
 	retrievedAt := &time.Time{}
@@ -941,50 +1222,65 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
+// 運賃の内訳。配車要求の時点でライドに記録する
+type fareBreakdown struct {
+	// 初乗り運賃
+	BaseFare int
+	// 距離に応じた運賃。混雑による倍率を掛けた後の額
+	MeteredFare int
+	// クーポンによる割引額
+	Discount int
+	// ユーザーが支払う額
+	Fare int
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
+// ride があればそのライドに紐づいたクーポンを使う。無ければ couponCode のクーポンか、自動で選んだクーポンを使う
+// 記録済みのライドの運賃はライドの内訳を参照し、これで計算し直さない
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, couponCode string, surgeMultiplier, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (fareBreakdown, error) {
 	var coupon Coupon
-	discount := 0
+	var applied *Coupon
 	if ride != nil {
 		destLatitude = ride.DestinationLatitude
 		destLongitude = ride.DestinationLongitude
 		pickupLatitude = ride.PickupLatitude
 		pickupLongitude = ride.PickupLongitude
+		surgeMultiplier = ride.SurgeMultiplier
 
-		// すでにクーポンが紐づいているならそれの割引額を参照
+		// すでにクーポンが紐づいているならそれの割引を参照
 		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
+				return fareBreakdown{}, err
 			}
 		} else {
-			discount = coupon.Discount
+			applied = &coupon
+		}
+	} else if couponCode != "" {
+		c, err := getAvailableCoupon(ctx, tx, userID, couponCode)
+		if err != nil {
+			return fareBreakdown{}, err
 		}
+		applied = c
 	} else {
 		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND "+couponAvailableCondition, userID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
+				return fareBreakdown{}, err
 			}
 
 			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
+			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND "+couponAvailableCondition+" ORDER BY created_at LIMIT 1", userID); err != nil {
 				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
+					return fareBreakdown{}, err
 				}
 			} else {
-				discount = coupon.Discount
+				applied = &coupon
 			}
 		} else {
-			discount = coupon.Discount
+			applied = &coupon
 		}
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
+	meteredFare := applySurge(farePerDistance*calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude), surgeMultiplier)
 
-	return initialFare + discountedMeteredFare, nil
+	return applyCoupon(applied, meteredFare), nil
 }
@@ -18,6 +18,10 @@ type AppCache struct {
 	chairTotalDistances Cache[string, *ChairTotalDistance]
 	latestChairLocation Cache[string, *ChairLocation]
 	activeRides         Cache[string, int]
+	// 受諾期限切れで割り当てを外された椅子。次のマッチングではそのライドに割り当てない
+	skippedChairs Cache[string, string]
+	// 椅子の最新の位置の索引。latestChairLocation と同時に更新する
+	chairGrid *chairGrid
 }
 
 func NewAppCache(ctx context.Context) *AppCache {
@@ -26,6 +30,8 @@ func NewAppCache(ctx context.Context) *AppCache {
 		chairTotalDistances: lo.Must1(NewInMemoryLRUCache[string, *ChairTotalDistance](1000)),
 		latestChairLocation: lo.Must1(NewInMemoryLRUCache[string, *ChairLocation](1000)),
 		activeRides:         lo.Must1(NewInMemoryLRUCache[string, int](1000)),
+		skippedChairs:       lo.Must1(NewInMemoryLRUCache[string, string](1000)),
+		chairGrid:           newChairGrid(chairGridCellSize),
 	}
 
 	// chairTotalDistances の初期化
@@ -61,6 +67,7 @@ func NewAppCache(ctx context.Context) *AppCache {
 	}
 	for _, chairLocation := range chairLocations {
 		_ = c.latestChairLocation.Set(context.Background(), chairLocation.ChairID, chairLocation)
+		c.chairGrid.Update(chairLocation.ChairID, Coordinate{Latitude: chairLocation.Latitude, Longitude: chairLocation.Longitude})
 	}
 
 	var chairs []Chair
@@ -73,10 +80,10 @@ func NewAppCache(ctx context.Context) *AppCache {
 		db.Select(&rides, `SELECT * FROM rides WHERE chair_id = ? ORDER BY created_at DESC`, chair.ID)
 
 		for _, ride := range rides {
-			// 過去にライドが存在し、かつ、それが完了していない場合はスキップ
+			// 過去にライドが存在し、かつ、それが完了もキャンセルもされていない場合はスキップ
 			status := lo.Must1(getLatestRideStatus(ctx, db, ride.ID))
 
-			if status != "COMPLETED" {
+			if !isRideFinished(status) {
 				count++
 			}
 		}
@@ -89,6 +96,7 @@ func NewAppCache(ctx context.Context) *AppCache {
 
 func updateLatestLocationCache(ctx context.Context, loc *ChairLocation) {
 	_ = cache.latestChairLocation.Set(ctx, loc.ChairID, loc)
+	cache.chairGrid.Update(loc.ChairID, Coordinate{Latitude: loc.Latitude, Longitude: loc.Longitude})
 }
 
 func updateTotalDistanceCache(ctx context.Context, prevLoc Maybe[*ChairLocation], loc *ChairLocation) {
@@ -0,0 +1,45 @@
+package main
+
+import "time"
+
+// 椅子の位置が記録されたときのイベント
+type ChairLocationEvent struct {
+	ChairID   string
+	Latitude  int
+	Longitude int
+	CreatedAt time.Time
+}
+
+var chairLocationEvents = NewEventBus[ChairLocationEvent]()
+
+func publishChairLocationEvent(location *ChairLocation) {
+	chairLocationEvents.Publish(ChairLocationEvent{
+		ChairID:   location.ChairID,
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+		CreatedAt: location.CreatedAt,
+	})
+}
+
+// 椅子そのものの変化の種類
+type ChairEventKind string
+
+const (
+	ChairEventRegistered ChairEventKind = "REGISTERED"
+	// 稼働状態が変わった。IsActive は変わった後の状態
+	ChairEventActivity ChairEventKind = "ACTIVITY"
+	// 名前が変わった。Name は変わった後の名前
+	ChairEventRenamed ChairEventKind = "RENAMED"
+	ChairEventRetired ChairEventKind = "RETIRED"
+)
+
+// 椅子の登録や稼働状態の変化などのイベント。オーナーの画面に反映するため OwnerID を入れる
+type ChairStateEvent struct {
+	Kind     ChairEventKind
+	ChairID  string
+	OwnerID  string
+	IsActive bool
+	Name     string
+}
+
+var chairStateEvents = NewEventBus[ChairStateEvent]()
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// 椅子の位置の索引に使う区画の一辺の長さ。nearby-chairs の既定の距離に合わせる
+const chairGridCellSize = 50
+
+type chairPosition struct {
+	ChairID    string
+	Coordinate Coordinate
+}
+
+type gridCell struct {
+	Latitude  int
+	Longitude int
+}
+
+// 椅子の最新の位置を一様な区画に分けて持つ索引
+// 複数の goroutine から同時に呼んでよい
+type chairGrid struct {
+	mu        sync.RWMutex
+	cellSize  int
+	cells     map[gridCell]map[string]struct{}
+	positions map[string]Coordinate
+	// 椅子がいる区画の範囲。探索をこの外に広げない
+	minCell gridCell
+	maxCell gridCell
+}
+
+func newChairGrid(cellSize int) *chairGrid {
+	return &chairGrid{
+		cellSize:  cellSize,
+		cells:     map[gridCell]map[string]struct{}{},
+		positions: map[string]Coordinate{},
+	}
+}
+
+func (g *chairGrid) cellOf(c Coordinate) gridCell {
+	return gridCell{
+		Latitude:  floorDiv(c.Latitude, g.cellSize),
+		Longitude: floorDiv(c.Longitude, g.cellSize),
+	}
+}
+
+// 椅子の位置を登録する。登録済みなら移動させる
+func (g *chairGrid) Update(chairID string, c Coordinate) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cell := g.cellOf(c)
+	if prev, ok := g.positions[chairID]; ok {
+		prevCell := g.cellOf(prev)
+		if prevCell != cell {
+			delete(g.cells[prevCell], chairID)
+			if len(g.cells[prevCell]) == 0 {
+				delete(g.cells, prevCell)
+			}
+		}
+	}
+	if _, ok := g.cells[cell]; !ok {
+		g.cells[cell] = map[string]struct{}{}
+	}
+	g.cells[cell][chairID] = struct{}{}
+
+	if len(g.positions) == 0 {
+		g.minCell, g.maxCell = cell, cell
+	} else {
+		g.minCell = gridCell{Latitude: min(g.minCell.Latitude, cell.Latitude), Longitude: min(g.minCell.Longitude, cell.Longitude)}
+		g.maxCell = gridCell{Latitude: max(g.maxCell.Latitude, cell.Latitude), Longitude: max(g.maxCell.Longitude, cell.Longitude)}
+	}
+	g.positions[chairID] = c
+}
+
+// c から distance 以内にいる椅子を返す。順序は不定
+func (g *chairGrid) Within(c Coordinate, distance int) []chairPosition {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	result := []chairPosition{}
+	if len(g.positions) == 0 || distance < 0 {
+		return result
+	}
+
+	from := g.cellOf(Coordinate{Latitude: c.Latitude - distance, Longitude: c.Longitude - distance})
+	to := g.cellOf(Coordinate{Latitude: c.Latitude + distance, Longitude: c.Longitude + distance})
+	from = gridCell{Latitude: max(from.Latitude, g.minCell.Latitude), Longitude: max(from.Longitude, g.minCell.Longitude)}
+	to = gridCell{Latitude: min(to.Latitude, g.maxCell.Latitude), Longitude: min(to.Longitude, g.maxCell.Longitude)}
+
+	// 見る区画の方が椅子より多いなら全ての椅子を調べた方が速い
+	if (to.Latitude-from.Latitude+1)*(to.Longitude-from.Longitude+1) > len(g.positions) {
+		for chairID, p := range g.positions {
+			if calculateDistance(c.Latitude, c.Longitude, p.Latitude, p.Longitude) <= distance {
+				result = append(result, chairPosition{ChairID: chairID, Coordinate: p})
+			}
+		}
+		return result
+	}
+
+	for lat := from.Latitude; lat <= to.Latitude; lat++ {
+		for lon := from.Longitude; lon <= to.Longitude; lon++ {
+			for chairID := range g.cells[gridCell{Latitude: lat, Longitude: lon}] {
+				p := g.positions[chairID]
+				if calculateDistance(c.Latitude, c.Longitude, p.Latitude, p.Longitude) <= distance {
+					result = append(result, chairPosition{ChairID: chairID, Coordinate: p})
+				}
+			}
+		}
+	}
+	return result
+}
+
+// c から近い順に、accept を満たす椅子を最大 limit 台返す
+// 中心の区画から外側へ1周ずつ広げ、それより外にもっと近い椅子がいないと分かった時点で探索をやめる
+// accept はロックを取ったまま呼ぶので、索引を操作してはいけない
+func (g *chairGrid) Nearest(c Coordinate, limit int, accept func(chairID string) bool) []chairPosition {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	found := []chairPosition{}
+	if len(g.positions) == 0 || limit <= 0 {
+		return found
+	}
+
+	center := g.cellOf(c)
+	// 中心から最も遠い区画までの周回数
+	maxRing := max(
+		center.Latitude-g.minCell.Latitude, g.maxCell.Latitude-center.Latitude,
+		center.Longitude-g.minCell.Longitude, g.maxCell.Longitude-center.Longitude,
+	)
+	visit := func(cell gridCell) {
+		for chairID := range g.cells[cell] {
+			if accept != nil && !accept(chairID) {
+				continue
+			}
+			found = append(found, chairPosition{ChairID: chairID, Coordinate: g.positions[chairID]})
+		}
+	}
+	sortFound := func() {
+		sort.Slice(found, func(i, j int) bool {
+			di := calculateDistance(c.Latitude, c.Longitude, found[i].Coordinate.Latitude, found[i].Coordinate.Longitude)
+			dj := calculateDistance(c.Latitude, c.Longitude, found[j].Coordinate.Latitude, found[j].Coordinate.Longitude)
+			if di != dj {
+				return di < dj
+			}
+			return found[i].ChairID < found[j].ChairID
+		})
+	}
+
+	for ring := 0; ring <= maxRing; ring++ {
+		if ring == 0 {
+			visit(center)
+		} else {
+			for d := -ring; d <= ring; d++ {
+				visit(gridCell{Latitude: center.Latitude - ring, Longitude: center.Longitude + d})
+				visit(gridCell{Latitude: center.Latitude + ring, Longitude: center.Longitude + d})
+			}
+			for d := -ring + 1; d <= ring-1; d++ {
+				visit(gridCell{Latitude: center.Latitude + d, Longitude: center.Longitude - ring})
+				visit(gridCell{Latitude: center.Latitude + d, Longitude: center.Longitude + ring})
+			}
+		}
+
+		// まだ見ていない区画の椅子は、少なくとも ring 周分の区画を隔てた先にいる
+		if len(found) >= limit {
+			sortFound()
+			last := found[limit-1].Coordinate
+			if calculateDistance(c.Latitude, c.Longitude, last.Latitude, last.Longitude) <= ring*g.cellSize {
+				return found[:limit]
+			}
+		}
+	}
+
+	sortFound()
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
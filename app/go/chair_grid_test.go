@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// 索引と比べるための、キャッシュの椅子を全て調べる素朴な実装
+type chairLocationScan struct {
+	chairIDs  []string
+	locations Cache[string, *ChairLocation]
+}
+
+func (s *chairLocationScan) Within(c Coordinate, distance int) []chairPosition {
+	result := []chairPosition{}
+	for _, chairID := range s.chairIDs {
+		location, _ := s.locations.Get(context.Background(), chairID)
+		if !location.Found {
+			continue
+		}
+		p := Coordinate{Latitude: location.Value.Latitude, Longitude: location.Value.Longitude}
+		if calculateDistance(c.Latitude, c.Longitude, p.Latitude, p.Longitude) <= distance {
+			result = append(result, chairPosition{ChairID: chairID, Coordinate: p})
+		}
+	}
+	return result
+}
+
+func (s *chairLocationScan) Nearest(c Coordinate, limit int, accept func(chairID string) bool) []chairPosition {
+	found := []chairPosition{}
+	for _, chairID := range s.chairIDs {
+		if accept != nil && !accept(chairID) {
+			continue
+		}
+		location, _ := s.locations.Get(context.Background(), chairID)
+		if !location.Found {
+			continue
+		}
+		found = append(found, chairPosition{ChairID: chairID, Coordinate: Coordinate{Latitude: location.Value.Latitude, Longitude: location.Value.Longitude}})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		di := calculateDistance(c.Latitude, c.Longitude, found[i].Coordinate.Latitude, found[i].Coordinate.Longitude)
+		dj := calculateDistance(c.Latitude, c.Longitude, found[j].Coordinate.Latitude, found[j].Coordinate.Longitude)
+		if di != dj {
+			return di < dj
+		}
+		return found[i].ChairID < found[j].ChairID
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// -area から area の範囲に椅子を置き、同じ位置を索引とキャッシュの両方に入れる
+func newChairGridFixture(tb testing.TB, r *rand.Rand, cellSize, chairs, area int) (*chairGrid, *chairLocationScan) {
+	tb.Helper()
+	grid := newChairGrid(cellSize)
+	locations, err := NewInMemoryLRUCache[string, *ChairLocation](chairs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	scan := &chairLocationScan{locations: locations}
+	for i := range chairs {
+		chairID := fmt.Sprintf("chair-%05d", i)
+		c := Coordinate{Latitude: r.IntN(area*2+1) - area, Longitude: r.IntN(area*2+1) - area}
+		grid.Update(chairID, c)
+		_ = locations.Set(context.Background(), chairID, &ChairLocation{ChairID: chairID, Latitude: c.Latitude, Longitude: c.Longitude})
+		scan.chairIDs = append(scan.chairIDs, chairID)
+	}
+	return grid, scan
+}
+
+func sortedByChairID(positions []chairPosition) []chairPosition {
+	sorted := slices.Clone(positions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ChairID < sorted[j].ChairID })
+	return sorted
+}
+
+func TestChairGridMatchesScan(t *testing.T) {
+	// 区画の境目をまたぐように、区画より広い範囲に負の座標も含めて置く
+	for _, cellSize := range []int{3, 7, chairGridCellSize} {
+		t.Run(fmt.Sprintf("cellSize=%d", cellSize), func(t *testing.T) {
+			r := rand.New(rand.NewPCG(1, uint64(cellSize)))
+			grid, scan := newChairGridFixture(t, r, cellSize, 500, 300)
+
+			// 椅子を動かして、区画の移動も確かめる
+			for i := range 100 {
+				chairID := scan.chairIDs[r.IntN(len(scan.chairIDs))]
+				c := Coordinate{Latitude: r.IntN(601) - 300, Longitude: r.IntN(601) - 300}
+				if i%10 == 0 {
+					// 今いる範囲の外へ動かす
+					c = Coordinate{Latitude: -400 - r.IntN(100), Longitude: 400 + r.IntN(100)}
+				}
+				grid.Update(chairID, c)
+				_ = scan.locations.Set(context.Background(), chairID, &ChairLocation{ChairID: chairID, Latitude: c.Latitude, Longitude: c.Longitude})
+			}
+
+			for range 200 {
+				c := Coordinate{Latitude: r.IntN(1201) - 600, Longitude: r.IntN(1201) - 600}
+
+				distance := r.IntN(200)
+				if got, want := sortedByChairID(grid.Within(c, distance)), sortedByChairID(scan.Within(c, distance)); !slices.Equal(got, want) {
+					t.Fatalf("Within(%v, %d) = %v, want %v", c, distance, got, want)
+				}
+
+				limit := 1 + r.IntN(30)
+				accept := func(chairID string) bool { return chairID[len(chairID)-1]%3 != 0 }
+				if got, want := grid.Nearest(c, limit, accept), scan.Nearest(c, limit, accept); !slices.Equal(got, want) {
+					t.Fatalf("Nearest(%v, %d) = %v, want %v", c, limit, got, want)
+				}
+				if got, want := grid.Nearest(c, limit, nil), scan.Nearest(c, limit, nil); !slices.Equal(got, want) {
+					t.Fatalf("Nearest(%v, %d, nil) = %v, want %v", c, limit, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChairGridEmpty(t *testing.T) {
+	grid := newChairGrid(chairGridCellSize)
+	if got := grid.Within(Coordinate{}, 100); len(got) != 0 {
+		t.Errorf("Within on empty grid = %v, want empty", got)
+	}
+	if got := grid.Nearest(Coordinate{}, 10, nil); len(got) != 0 {
+		t.Errorf("Nearest on empty grid = %v, want empty", got)
+	}
+}
+
+// 椅子の数は本番の規模 (530 台ほど) に合わせる
+const benchmarkChairs = 600
+
+func BenchmarkChairGridWithin(b *testing.B) {
+	r := rand.New(rand.NewPCG(1, 2))
+	grid, _ := newChairGridFixture(b, r, chairGridCellSize, benchmarkChairs, 300)
+	b.ResetTimer()
+	for i := range b.N {
+		grid.Within(Coordinate{Latitude: i%601 - 300, Longitude: (i*7)%601 - 300}, 50)
+	}
+}
+
+func BenchmarkChairLocationScanWithin(b *testing.B) {
+	r := rand.New(rand.NewPCG(1, 2))
+	_, scan := newChairGridFixture(b, r, chairGridCellSize, benchmarkChairs, 300)
+	b.ResetTimer()
+	for i := range b.N {
+		scan.Within(Coordinate{Latitude: i%601 - 300, Longitude: (i*7)%601 - 300}, 50)
+	}
+}
+
+func BenchmarkChairGridNearest(b *testing.B) {
+	r := rand.New(rand.NewPCG(1, 2))
+	grid, _ := newChairGridFixture(b, r, chairGridCellSize, benchmarkChairs, 300)
+	b.ResetTimer()
+	for i := range b.N {
+		grid.Nearest(Coordinate{Latitude: i%601 - 300, Longitude: (i*7)%601 - 300}, matchingCandidatesPerRide, nil)
+	}
+}
+
+func BenchmarkChairLocationScanNearest(b *testing.B) {
+	r := rand.New(rand.NewPCG(1, 2))
+	_, scan := newChairGridFixture(b, r, chairGridCellSize, benchmarkChairs, 300)
+	b.ResetTimer()
+	for i := range b.N {
+		scan.Nearest(Coordinate{Latitude: i%601 - 300, Longitude: (i*7)%601 - 300}, matchingCandidatesPerRide, nil)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -62,6 +63,7 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	})
 
 	cache.activeRides.Set(ctx, chairID, 0)
+	chairStateEvents.Publish(ChairStateEvent{Kind: ChairEventRegistered, ChairID: chairID, OwnerID: owner.ID, Name: req.Name})
 
 	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
 		ID:      chairID,
@@ -83,11 +85,33 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	// 認証した後にオーナーが停止や引退をさせていても稼働に戻さないように、更新する行で確かめる
+	result, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ? AND (? = FALSE OR (owner_disabled = FALSE AND retired_at IS NULL))", req.IsActive, chair.ID, req.IsActive)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count > 0 {
+		chairStateEvents.Publish(ChairStateEvent{Kind: ChairEventActivity, ChairID: chair.ID, OwnerID: chair.OwnerID, IsActive: req.IsActive})
+	} else {
+		// 値が変わらない場合も 0 になるので、更新できなかった理由を読み直す
+		current := &Chair{}
+		if err := db.GetContext(ctx, current, "SELECT * FROM chairs WHERE id = ?", chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if req.IsActive && current.RetiredAt.Valid {
+			writeError(w, http.StatusForbidden, errChairRetired)
+			return
+		}
+		if req.IsActive && current.OwnerDisabled {
+			writeError(w, http.StatusForbidden, errors.New("chair is disabled by owner"))
+			return
+		}
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -144,11 +168,35 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	chair := ctx.Value("chair").(*Chair)
 
-	tx, err := db.Beginx()
+	if acceptsEventStream(r) {
+		// トークンを作り直したり引退させたりしたら、このストリームも閉じる
+		streamCtx, closeStream := chairStreams.Open(ctx, chair.ID)
+		defer closeStream()
+		serveNotificationStream(w, r.WithContext(streamCtx), isChairRideEvent(chair.ID), func(ctx context.Context) (*chairGetNotificationResponseData, bool, error) {
+			return getChairNotification(ctx, chair)
+		})
+		return
+	}
+
+	data, _, err := getChairNotification(ctx, chair)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+
+	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+		Data:         data,
+		RetryAfterMs: 1000,
+	})
+}
+
+// 未送信のステータスがあれば最も古いものを送信済みにして返し、無ければ最新のステータスを返す
+// 未送信のステータスを返したかどうかを2つ目の戻り値で返す
+func getChairNotification(ctx context.Context, chair *Chair) (*chairGetNotificationResponseData, bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, false, err
+	}
 	defer tx.Rollback()
 	ride := &Ride{}
 	yetSentRideStatus := RideStatus{}
@@ -156,25 +204,19 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-				RetryAfterMs: 1000,
-			})
-			return
+			return nil, false, nil
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
 	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			status, err = getLatestRideStatus(ctx, tx, ride.ID)
 			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, false, err
 			}
 		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, false, err
 		}
 	} else {
 		status = yetSentRideStatus.Status
@@ -183,42 +225,36 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	user := &User{}
 	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
 	if yetSentRideStatus.ID != "" {
 		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, false, err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
-	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-		Data: &chairGetNotificationResponseData{
-			RideID: ride.ID,
-			User: simpleUser{
-				ID:   user.ID,
-				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-			},
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Status: status,
+	return &chairGetNotificationResponseData{
+		RideID: ride.ID,
+		User: simpleUser{
+			ID:   user.ID,
+			Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
 		},
-		RetryAfterMs: 1000,
-	})
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Status: status,
+	}, yetSentRideStatus.ID != "", nil
 }
 
 type postChairRidesRideIDStatusRequest struct {
@@ -259,30 +295,22 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch req.Status {
-	// Acknowledge the ride
-	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	// After Picking up user
-	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "PICKUP" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
-			return
-		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	default:
+	// ENROUTE: Acknowledge the ride, CARRYING: After Picking up user
+	if req.Status != "ENROUTE" && req.Status != "CARRYING" {
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	event, err := insertRideStatus(ctx, tx, ride, status, req.Status, rideActorChair)
+	if err != nil {
+		writeRideStatusError(w, err)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -290,5 +318,25 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publishRideStatusEvents(event)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func chairPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	chair := ctx.Value("chair").(*Chair)
+
+	if _, err := cancelRide(ctx, rideID, rideActorChair, func(ride *Ride) error {
+		if ride.ChairID.String != chair.ID {
+			return errRideNotAssigned
+		}
+		return nil
+	}); err != nil {
+		writeCancelRideError(w, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// 椅子ごとの通知のストリーム。トークンの作り直しや引退のときに開いているストリームを閉じる
+// 閉じられるのはこのプロセスで開いたストリームだけ
+type chairStreamRegistry struct {
+	mu      sync.Mutex
+	nextID  int
+	cancels map[string]map[int]context.CancelFunc
+}
+
+var chairStreams = &chairStreamRegistry{
+	cancels: map[string]map[int]context.CancelFunc{},
+}
+
+// Close で閉じられる context と、ストリームを終えたときに呼ぶ関数を返す
+func (s *chairStreamRegistry) Open(ctx context.Context, chairID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	if s.cancels[chairID] == nil {
+		s.cancels[chairID] = map[int]context.CancelFunc{}
+	}
+	s.cancels[chairID][id] = cancel
+	s.mu.Unlock()
+
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.cancels[chairID], id)
+		if len(s.cancels[chairID]) == 0 {
+			delete(s.cancels, chairID)
+		}
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// 椅子の開いているストリームを全て閉じる
+func (s *chairStreamRegistry) Close(chairID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cancel := range s.cancels[chairID] {
+		cancel()
+	}
+}
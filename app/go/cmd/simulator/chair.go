@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"time"
+)
+
+type coordinate struct {
+	Latitude  int `json:"latitude"`
+	Longitude int `json:"longitude"`
+}
+
+type chairNotification struct {
+	Data *struct {
+		RideID                string     `json:"ride_id"`
+		PickupCoordinate      coordinate `json:"pickup_coordinate"`
+		DestinationCoordinate coordinate `json:"destination_coordinate"`
+		Status                string     `json:"status"`
+	} `json:"data"`
+}
+
+// 1台の椅子。クッキーで認証するので椅子ごとにクライアントを持つ
+type chairSimulator struct {
+	target   string
+	client   *http.Client
+	id       string
+	name     string
+	model    chairModel
+	position coordinate
+
+	rideID string
+	status string
+	// 向かっている位置。無ければ止まっている
+	destination *coordinate
+}
+
+func newClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar, Timeout: 10 * time.Second}
+}
+
+func registerOwner(ctx context.Context, target, name string) (string, error) {
+	res := struct {
+		ChairRegisterToken string `json:"chair_register_token"`
+	}{}
+	if err := request(ctx, newClient(), http.MethodPost, target+"/api/owner/owners", map[string]string{"name": name}, &res); err != nil {
+		return "", err
+	}
+	return res.ChairRegisterToken, nil
+}
+
+func registerChair(ctx context.Context, target, registerToken, name string, model chairModel, start coordinate) (*chairSimulator, error) {
+	s := &chairSimulator{
+		target:   target,
+		client:   newClient(),
+		name:     name,
+		model:    model,
+		position: start,
+	}
+	res := struct {
+		ID string `json:"id"`
+	}{}
+	if err := request(ctx, s.client, http.MethodPost, target+"/api/chair/chairs", map[string]string{
+		"name":                 name,
+		"model":                model.Name,
+		"chair_register_token": registerToken,
+	}, &res); err != nil {
+		return nil, err
+	}
+	s.id = res.ID
+
+	if err := s.setActive(ctx, true); err != nil {
+		return nil, err
+	}
+	if err := s.postCoordinate(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *chairSimulator) setActive(ctx context.Context, active bool) error {
+	return request(ctx, s.client, http.MethodPost, s.target+"/api/chair/activity", map[string]bool{"is_active": active}, nil)
+}
+
+func (s *chairSimulator) postCoordinate(ctx context.Context) error {
+	return request(ctx, s.client, http.MethodPost, s.target+"/api/chair/coordinate", s.position, nil)
+}
+
+func (s *chairSimulator) postRideStatus(ctx context.Context, status string) error {
+	return request(ctx, s.client, http.MethodPost, s.target+"/api/chair/rides/"+s.rideID+"/status", map[string]string{"status": status}, nil)
+}
+
+// interval ごとに通知を確認し、目的の位置があればそこへ向かって1回分進む
+func (s *chairSimulator) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.tick(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("chair tick failed", slog.String("chair", s.name), slog.Any("error", err))
+		}
+	}
+}
+
+func (s *chairSimulator) tick(ctx context.Context) error {
+	notification := &chairNotification{}
+	if err := request(ctx, s.client, http.MethodGet, s.target+"/api/chair/notification", nil, notification); err != nil {
+		return err
+	}
+	if data := notification.Data; data != nil && (data.RideID != s.rideID || data.Status != s.status) {
+		slog.Info("ride status changed", slog.String("chair", s.name), slog.String("ride_id", data.RideID), slog.String("status", data.Status))
+		s.rideID = data.RideID
+
+		switch data.Status {
+		case "MATCHING":
+			// 割り当てられたライドを受諾して配車位置へ向かう
+			if err := s.postRideStatus(ctx, "ENROUTE"); err != nil {
+				return err
+			}
+			s.destination = &data.PickupCoordinate
+		case "ENROUTE":
+			s.destination = &data.PickupCoordinate
+		case "PICKUP":
+			// ユーザーを乗せて目的地へ向かう
+			if err := s.postRideStatus(ctx, "CARRYING"); err != nil {
+				return err
+			}
+			s.destination = &data.DestinationCoordinate
+		case "CARRYING":
+			s.destination = &data.DestinationCoordinate
+		default:
+			// 到着後はユーザーの評価を待ち、完了やキャンセルの後は次の割り当てを待つ
+			s.destination = nil
+		}
+		// 受諾などに失敗した場合は、次の確認でもう一度行う
+		s.status = data.Status
+	}
+
+	if s.destination == nil || s.position == *s.destination {
+		return nil
+	}
+	s.position = step(s.position, *s.destination, s.model.Speed)
+	return s.postCoordinate(ctx)
+}
+
+// from から to へ、マンハッタン距離で最大 speed だけ進んだ位置を返す。緯度、経度の順に合わせる
+// 到着の判定は座標の完全一致なので、行き過ぎないようにする
+func step(from, to coordinate, speed int) coordinate {
+	speed = max(speed, 1)
+	move := func(a, b, budget int) (int, int) {
+		d := min(abs(b-a), budget)
+		if b < a {
+			return a - d, budget - d
+		}
+		return a + d, budget - d
+	}
+	var rest int
+	from.Latitude, rest = move(from.Latitude, to.Latitude, speed)
+	from.Longitude, _ = move(from.Longitude, to.Longitude, rest)
+	return from
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func request(ctx context.Context, client *http.Client, method, url string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s %s: unexpected status %d: %s", method, url, res.StatusCode, bytes.TrimSpace(msg))
+	}
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
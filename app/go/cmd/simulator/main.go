@@ -0,0 +1,149 @@
+// ローカル開発用の椅子のシミュレーター
+// オーナーと椅子を登録し、椅子ごとに通知を見てライドを受諾し、モデルの速さで配車位置と目的地へ移動させる
+// ユーザー側の操作 (配車要求と評価) は行わないので、フロントエンドや curl で行う
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+type chairModel struct {
+	Name  string `db:"name"`
+	Speed int    `db:"speed"`
+}
+
+func main() {
+	var (
+		target   = flag.String("target", "http://localhost:8080", "アプリケーションの URL")
+		owners   = flag.Int("owners", 1, "登録するオーナーの数")
+		chairs   = flag.Int("chairs", 5, "オーナーごとに登録する椅子の数")
+		interval = flag.Duration("interval", time.Second, "椅子が通知を確認して座標を送る間隔。アプリケーションが到着見込み時間の計算に使う間隔と合わせる")
+		area     = flag.Int("area", 300, "椅子を置く範囲。最初の位置を縦横 -area から area の間で決める")
+		model    = flag.String("model", "", "登録する椅子のモデル。省略した場合はモデルを順に使う")
+	)
+	flag.Parse()
+	if *owners <= 0 || *chairs <= 0 || *interval <= 0 || *area < 0 {
+		slog.Error("owners, chairs, interval must be positive and area must not be negative")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	models, err := loadChairModels(ctx, *model)
+	if err != nil {
+		slog.Error("failed to load chair models", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	simulators := []*chairSimulator{}
+	for i := range *owners {
+		ownerName := fmt.Sprintf("simulator-owner-%d-%d", time.Now().Unix(), i)
+		registerToken, err := registerOwner(ctx, *target, ownerName)
+		if err != nil {
+			slog.Error("failed to register owner", slog.Any("error", err))
+			os.Exit(1)
+		}
+		for j := range *chairs {
+			m := models[(i*(*chairs)+j)%len(models)]
+			start := coordinate{
+				Latitude:  rand.IntN(*area*2+1) - *area,
+				Longitude: rand.IntN(*area*2+1) - *area,
+			}
+			s, err := registerChair(ctx, *target, registerToken, fmt.Sprintf("%s-chair-%d", ownerName, j), m, start)
+			if err != nil {
+				slog.Error("failed to register chair", slog.Any("error", err))
+				os.Exit(1)
+			}
+			simulators = append(simulators, s)
+		}
+	}
+	slog.Info("registered chairs", slog.Int("owners", *owners), slog.Int("chairs", len(simulators)))
+
+	var wg sync.WaitGroup
+	for _, s := range simulators {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(ctx, *interval)
+		}()
+	}
+	wg.Wait()
+
+	// 終了した椅子がマッチングされないように稼働を止める
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, s := range simulators {
+		if err := s.setActive(shutdownCtx, false); err != nil {
+			slog.Warn("failed to deactivate chair", slog.String("chair_id", s.id), slog.Any("error", err))
+		}
+	}
+}
+
+// 速さは API から取れないので、アプリケーションと同じ環境変数で DB に接続して読む
+func loadChairModels(ctx context.Context, only string) ([]chairModel, error) {
+	host := os.Getenv("ISUCON_DB_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := os.Getenv("ISUCON_DB_PORT")
+	if port == "" {
+		port = "3306"
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("invalid ISUCON_DB_PORT: %w", err)
+	}
+	user := os.Getenv("ISUCON_DB_USER")
+	if user == "" {
+		user = "isucon"
+	}
+	password := os.Getenv("ISUCON_DB_PASSWORD")
+	if password == "" {
+		password = "isucon"
+	}
+	dbname := os.Getenv("ISUCON_DB_NAME")
+	if dbname == "" {
+		dbname = "isuride"
+	}
+
+	dbConfig := mysql.NewConfig()
+	dbConfig.User = user
+	dbConfig.Passwd = password
+	dbConfig.Addr = net.JoinHostPort(host, port)
+	dbConfig.Net = "tcp"
+	dbConfig.DBName = dbname
+
+	db, err := sqlx.ConnectContext(ctx, "mysql", dbConfig.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	models := []chairModel{}
+	if only != "" {
+		err = db.SelectContext(ctx, &models, "SELECT name, speed FROM chair_models WHERE name = ?", only)
+	} else {
+		err = db.SelectContext(ctx, &models, "SELECT name, speed FROM chair_models ORDER BY name")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("chair model not found: %q", only)
+	}
+	return models, nil
+}
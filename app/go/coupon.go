@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var errCouponNotAvailable = errors.New("coupon is not available")
+
+// 未使用で、利用開始日時と有効期限の範囲内にあるクーポンだけを使う
+// 期限の判定は DB の時刻で行う
+const couponAvailableCondition = "used_by IS NULL AND (starts_at IS NULL OR starts_at <= CURRENT_TIMESTAMP(6)) AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP(6))"
+
+// クーポンの割引の種類
+const (
+	// 距離に応じた運賃から discount を引く
+	couponKindAmount = "AMOUNT"
+	// 距離に応じた運賃から discount パーセントを引く。discount_cap があればそれを上限にする
+	couponKindPercent = "PERCENT"
+	// 初乗り運賃を無料にする
+	couponKindWaiveInitialFare = "WAIVE_INITIAL_FARE"
+)
+
+func isValidCouponKind(kind string) bool {
+	return kind == couponKindAmount || kind == couponKindPercent || kind == couponKindWaiveInitialFare
+}
+
+// 距離に応じた運賃にクーポンを適用した内訳を返す。coupon が nil なら割引しない
+// 割引額は初乗り運賃を無料にするクーポン以外、距離に応じた運賃を超えない
+func applyCoupon(coupon *Coupon, meteredFare int) fareBreakdown {
+	discount := 0
+	if coupon != nil {
+		switch coupon.DiscountKind {
+		case couponKindPercent:
+			discount = meteredFare * coupon.Discount / 100
+			if coupon.DiscountCap.Valid {
+				discount = min(discount, int(coupon.DiscountCap.Int64))
+			}
+			discount = min(discount, meteredFare)
+		case couponKindWaiveInitialFare:
+			discount = initialFare
+		default:
+			discount = min(coupon.Discount, meteredFare)
+		}
+	}
+
+	return fareBreakdown{
+		BaseFare:    initialFare,
+		MeteredFare: meteredFare,
+		Discount:    discount,
+		Fare:        initialFare + meteredFare - discount,
+	}
+}
+
+// 指定したコードのクーポンをユーザーが持っていて今使えるなら、ロックして返す
+func getAvailableCoupon(ctx context.Context, tx *sqlx.Tx, userID, code string) (*Coupon, error) {
+	coupon := &Coupon{}
+	if err := tx.GetContext(ctx, coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = ? AND "+couponAvailableCondition+" FOR UPDATE", userID, code); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errCouponNotAvailable
+		}
+		return nil, err
+	}
+	return coupon, nil
+}
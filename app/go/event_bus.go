@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// プロセス内の publish/subscribe
+// Publish はブロックしないので、複数の goroutine から同時に呼んでよい
+type EventBus[T any] struct {
+	mu          sync.RWMutex
+	nextID      int
+	subscribers map[int]*eventSubscriber[T]
+}
+
+type eventSubscriber[T any] struct {
+	ch     chan T
+	filter func(T) bool
+	// イベントを捨てたことを知らせる。知らせを受け取るまでは何度捨てても1回だけ知らせる
+	dropped chan struct{}
+}
+
+func NewEventBus[T any]() *EventBus[T] {
+	return &EventBus[T]{
+		subscribers: map[int]*eventSubscriber[T]{},
+	}
+}
+
+// filter を満たすイベントを受け取るチャネルと、購読をやめるための関数を返す
+// filter が nil なら全てのイベントを受け取る
+func (b *EventBus[T]) Subscribe(bufferSize int, filter func(T) bool) (<-chan T, func()) {
+	ch, _, unsubscribe := b.SubscribeWithDrops(bufferSize, filter)
+	return ch, unsubscribe
+}
+
+// Subscribe と同じだが、バッファが埋まってイベントを捨てたことを知らせるチャネルも返す
+// イベントを積み上げて状態を組み立てる購読者は、知らせを受けたら状態を読み直す
+func (b *EventBus[T]) SubscribeWithDrops(bufferSize int, filter func(T) bool) (<-chan T, <-chan struct{}, func()) {
+	s := &eventSubscriber[T]{
+		ch:      make(chan T, bufferSize),
+		filter:  filter,
+		dropped: make(chan struct{}, 1),
+	}
+
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = s
+	b.mu.Unlock()
+
+	var once sync.Once
+	return s.ch, s.dropped, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, id)
+			b.mu.Unlock()
+			close(s.ch)
+		})
+	}
+}
+
+// 購読者のバッファが埋まっている場合、その購読者へのイベントは捨てる
+func (b *EventBus[T]) Publish(event T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		if s.filter != nil && !s.filter(event) {
+			continue
+		}
+		select {
+		case s.ch <- event:
+		default:
+			slog.Warn("event dropped because subscriber is too slow")
+			select {
+			case s.dropped <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
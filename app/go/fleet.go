@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ownerGetFleetResponse struct {
+	Chairs []ownerFleetChair `json:"chairs"`
+}
+
+type ownerFleetChair struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Model  string `json:"model"`
+	Active bool   `json:"active"`
+	// 位置が記録されていない椅子は null
+	Coordinate          *Coordinate     `json:"coordinate"`
+	CoordinateUpdatedAt *int64          `json:"coordinate_updated_at"`
+	Ride                *ownerFleetRide `json:"ride"`
+	// ライドを担当していない椅子の、最後にライドを終えた日時 (無ければ登録日時) と、そこからの経過ミリ秒
+	IdleSince    *int64 `json:"idle_since"`
+	IdleDuration *int64 `json:"idle_duration"`
+}
+
+type ownerFleetRide struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// 椅子1台分の状態。SSE ではイベントを受け取るたびにこれを更新して送る
+type fleetChairState struct {
+	chair      Chair
+	location   *ChairLocation
+	rideID     string
+	rideStatus string
+	idleSince  time.Time
+}
+
+func (s *fleetChairState) applyRideEvent(event RideStatusEvent) {
+	if event.Kind == RideEventUnassigned {
+		if s.rideID == event.RideID {
+			s.rideID = ""
+			s.rideStatus = ""
+		}
+		return
+	}
+	switch event.Status {
+	case "COMPLETED", "CANCELED":
+		s.rideID = ""
+		s.rideStatus = ""
+		s.idleSince = event.CreatedAt
+	default:
+		s.rideID = event.RideID
+		s.rideStatus = event.Status
+	}
+}
+
+func (s *fleetChairState) applyLocationEvent(event ChairLocationEvent) {
+	s.location = &ChairLocation{
+		ChairID:   event.ChairID,
+		Latitude:  event.Latitude,
+		Longitude: event.Longitude,
+		CreatedAt: event.CreatedAt,
+	}
+}
+
+func (s *fleetChairState) applyChairEvent(event ChairStateEvent) {
+	switch event.Kind {
+	case ChairEventActivity:
+		s.chair.IsActive = event.IsActive
+	case ChairEventRenamed:
+		s.chair.Name = event.Name
+	}
+}
+
+func (s *fleetChairState) response(now time.Time) ownerFleetChair {
+	c := ownerFleetChair{
+		ID:     s.chair.ID,
+		Name:   s.chair.Name,
+		Model:  s.chair.Model,
+		Active: s.chair.IsActive,
+	}
+	if s.location != nil {
+		c.Coordinate = &Coordinate{Latitude: s.location.Latitude, Longitude: s.location.Longitude}
+		t := s.location.CreatedAt.UnixMilli()
+		c.CoordinateUpdatedAt = &t
+	}
+	if s.rideID != "" {
+		c.Ride = &ownerFleetRide{ID: s.rideID, Status: s.rideStatus}
+	} else {
+		since := s.idleSince.UnixMilli()
+		idle := max(now.Sub(s.idleSince).Milliseconds(), 0)
+		c.IdleSince = &since
+		c.IdleDuration = &idle
+	}
+	return c
+}
+
+func getOwnerFleetChairs(ctx context.Context, ownerID string) ([]Chair, error) {
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ? AND retired_at IS NULL ORDER BY created_at", ownerID); err != nil {
+		return nil, err
+	}
+	return chairs, nil
+}
+
+// 椅子ごとの現在のライドと、最後にライドを終えた日時を読み出す。位置はキャッシュから取る
+func loadFleetStates(ctx context.Context, ownerID string, chairs []Chair) ([]*fleetChairState, error) {
+	states := make([]*fleetChairState, 0, len(chairs))
+	byChairID := map[string]*fleetChairState{}
+	for _, chair := range chairs {
+		s := &fleetChairState{chair: chair, idleSince: chair.CreatedAt}
+		if location, _ := cache.latestChairLocation.Get(ctx, chair.ID); location.Found {
+			s.location = location.Value
+		}
+		states = append(states, s)
+		byChairID[chair.ID] = s
+	}
+
+	// 担当中のライドと、その最新の状態
+	activeRides := []struct {
+		ID      string `db:"id"`
+		ChairID string `db:"chair_id"`
+		Status  string `db:"status"`
+	}{}
+	if err := db.SelectContext(ctx, &activeRides, `
+		SELECT rides.id, rides.chair_id,
+		       (SELECT status FROM ride_statuses WHERE ride_statuses.ride_id = rides.id ORDER BY created_at DESC LIMIT 1) AS status
+		FROM rides
+		JOIN chairs ON chairs.id = rides.chair_id
+		WHERE chairs.owner_id = ?
+		  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status IN ('COMPLETED', 'CANCELED'))
+	`, ownerID); err != nil {
+		return nil, err
+	}
+	for _, ride := range activeRides {
+		if s, ok := byChairID[ride.ChairID]; ok {
+			s.rideID = ride.ID
+			s.rideStatus = ride.Status
+		}
+	}
+
+	finished := []struct {
+		ChairID    string    `db:"chair_id"`
+		FinishedAt time.Time `db:"finished_at"`
+	}{}
+	if err := db.SelectContext(ctx, &finished, `
+		SELECT rides.chair_id, MAX(ride_statuses.created_at) AS finished_at FROM ride_statuses
+		JOIN rides ON rides.id = ride_statuses.ride_id
+		JOIN chairs ON chairs.id = rides.chair_id
+		WHERE chairs.owner_id = ?
+		  AND ride_statuses.status IN ('COMPLETED', 'CANCELED')
+		GROUP BY rides.chair_id
+	`, ownerID); err != nil {
+		return nil, err
+	}
+	for _, f := range finished {
+		if s, ok := byChairID[f.ChairID]; ok {
+			s.idleSince = f.FinishedAt
+		}
+	}
+
+	return states, nil
+}
+
+func ownerGetFleet(w http.ResponseWriter, r *http.Request) {
+	if acceptsEventStream(r) {
+		serveOwnerFleetStream(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairs, err := getOwnerFleetChairs(ctx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	states, err := loadFleetStates(ctx, owner.ID, chairs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, fleetResponse(states))
+}
+
+func fleetResponse(states []*fleetChairState) *ownerGetFleetResponse {
+	now := time.Now()
+	res := &ownerGetFleetResponse{Chairs: make([]ownerFleetChair, 0, len(states))}
+	for _, s := range states {
+		res.Chairs = append(res.Chairs, s.response(now))
+	}
+	return res
+}
+
+// 最初に snapshot イベントで全ての椅子を送り、その後は椅子の位置やライドの状態、稼働状態が変わるたびに chair イベントでその椅子だけを送る
+// 変化はイベントから組み立てるので、DB を読み直すのは椅子の顔ぶれが変わったときとイベントを取りこぼしたときだけ
+// そのときは読み直した全ての椅子を snapshot イベントで送り直す
+func serveOwnerFleetStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	rc := http.NewResponseController(w)
+
+	// イベントは発行した goroutine でふるいにかけるので、椅子の顔ぶれはロックして読み書きする
+	var ownedMu sync.RWMutex
+	owned := map[string]struct{}{}
+	isOwned := func(chairID string) bool {
+		ownedMu.RLock()
+		defer ownedMu.RUnlock()
+		_, ok := owned[chairID]
+		return ok
+	}
+
+	// 取りこぼさないように、状態を読み出す前に購読しておく
+	rideEvents, rideDropped, unsubscribeRides := rideStatusEvents.SubscribeWithDrops(256, func(event RideStatusEvent) bool {
+		return isOwned(event.ChairID)
+	})
+	defer unsubscribeRides()
+	locationEvents, locationDropped, unsubscribeLocations := chairLocationEvents.SubscribeWithDrops(256, func(event ChairLocationEvent) bool {
+		return isOwned(event.ChairID)
+	})
+	defer unsubscribeLocations()
+	chairEvents, chairDropped, unsubscribeChairs := chairStateEvents.SubscribeWithDrops(64, func(event ChairStateEvent) bool {
+		return event.OwnerID == owner.ID
+	})
+	defer unsubscribeChairs()
+
+	byChairID := map[string]*fleetChairState{}
+	load := func() (*ownerGetFleetResponse, error) {
+		// 溜まっているイベントは読み直す状態に含まれるので捨てる。後から古い状態に戻さないようにする
+		drainChannel(rideEvents)
+		drainChannel(locationEvents)
+		drainChannel(chairEvents)
+		drainChannel(rideDropped)
+		drainChannel(locationDropped)
+		drainChannel(chairDropped)
+
+		chairs, err := getOwnerFleetChairs(ctx, owner.ID)
+		if err != nil {
+			return nil, err
+		}
+		ownedMu.Lock()
+		clear(owned)
+		for _, chair := range chairs {
+			owned[chair.ID] = struct{}{}
+		}
+		ownedMu.Unlock()
+
+		states, err := loadFleetStates(ctx, owner.ID, chairs)
+		if err != nil {
+			return nil, err
+		}
+		clear(byChairID)
+		for _, s := range states {
+			byChairID[s.chair.ID] = s
+		}
+		return fleetResponse(states), nil
+	}
+
+	snapshot, err := load()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx にバッファさせず、イベントをすぐに届ける
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(notificationKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		if snapshot != nil {
+			if err := writeNamedEvent(w, "snapshot", snapshot); err != nil {
+				return
+			}
+			snapshot = nil
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		var updated *fleetChairState
+		reload := false
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-rideEvents:
+			if !ok {
+				return
+			}
+			if updated = byChairID[event.ChairID]; updated != nil {
+				updated.applyRideEvent(event)
+			}
+		case event, ok := <-locationEvents:
+			if !ok {
+				return
+			}
+			if updated = byChairID[event.ChairID]; updated != nil {
+				updated.applyLocationEvent(event)
+			}
+		case event, ok := <-chairEvents:
+			if !ok {
+				return
+			}
+			switch event.Kind {
+			case ChairEventRegistered, ChairEventRetired:
+				reload = true
+			default:
+				if updated = byChairID[event.ChairID]; updated != nil {
+					updated.applyChairEvent(event)
+				}
+			}
+		case <-rideDropped:
+			reload = true
+		case <-locationDropped:
+			reload = true
+		case <-chairDropped:
+			reload = true
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+
+		if reload {
+			snapshot, err = load()
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("failed to load fleet", slog.Any("error", err))
+				}
+				return
+			}
+			continue
+		}
+		if updated != nil {
+			if err := writeNamedEvent(w, "chair", updated.response(time.Now())); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func drainChannel[T any](ch <-chan T) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 招待の条件。settings テーブルで変更でき、無ければ既定値を使う
+type invitationRules struct {
+	// 1つの招待コードを使える人数。0 なら無制限
+	MaxUses int
+	// 招待された人に付与するクーポンの割引額
+	InviteeDiscount int
+	// 招待した人に付与するクーポンの割引額
+	InviterReward int
+}
+
+var defaultInvitationRules = invitationRules{
+	MaxUses:         3,
+	InviteeDiscount: 1500,
+	InviterReward:   1000,
+}
+
+func getInvitationRules(ctx context.Context, tx sqlx.QueryerContext) (invitationRules, error) {
+	rules := defaultInvitationRules
+
+	settings := []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}{}
+	if err := sqlx.SelectContext(ctx, tx, &settings, "SELECT name, value FROM settings WHERE name IN ('invitation_max_uses', 'invitation_invitee_discount', 'invitation_inviter_reward')"); err != nil {
+		return rules, err
+	}
+
+	for _, setting := range settings {
+		value, err := strconv.Atoi(setting.Value)
+		if err != nil || value < 0 {
+			slog.Warn("invalid invitation setting, fallback to default", slog.String("name", setting.Name), slog.String("value", setting.Value))
+			continue
+		}
+		switch setting.Name {
+		case "invitation_max_uses":
+			rules.MaxUses = value
+		case "invitation_invitee_discount":
+			rules.InviteeDiscount = value
+		case "invitation_inviter_reward":
+			rules.InviterReward = value
+		}
+	}
+	return rules, nil
+}
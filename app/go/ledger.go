@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 台帳の勘定科目
+// 借方を正、貸方を負で記録し、1つの取引の仕訳の合計は必ず 0 になる
+const (
+	// ユーザーに請求した額 (借方)
+	ledgerAccountUserCharge = "USER_CHARGE"
+	// 運営が負担したクーポンの割引額 (借方)
+	ledgerAccountCouponSubsidy = "COUPON_SUBSIDY"
+	// 運営の手数料 (貸方)。返金したときは借方に戻す
+	ledgerAccountPlatformCommission = "PLATFORM_COMMISSION"
+	// オーナーの取り分 (貸方)。返金したときは借方に戻す
+	ledgerAccountOwnerEarning = "OWNER_EARNING"
+	// ユーザーに返金した額 (貸方)
+	ledgerAccountRefund = "REFUND"
+)
+
+// 手数料率は千分率。settings テーブルで変更でき、無ければ既定値を使う
+const defaultCommissionRatePermille = 100
+
+func getCommissionRatePermille(ctx context.Context, q sqlx.QueryerContext) (int, error) {
+	values := []string{}
+	if err := sqlx.SelectContext(ctx, q, &values, "SELECT value FROM settings WHERE name = 'commission_rate_permille'"); err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return defaultCommissionRatePermille, nil
+	}
+	rate, err := strconv.Atoi(values[0])
+	if err != nil || rate < 0 || rate > 1000 {
+		slog.Warn("invalid commission_rate_permille, fallback to default", slog.String("value", values[0]))
+		return defaultCommissionRatePermille, nil
+	}
+	return rate, nil
+}
+
+type ledgerEntry struct {
+	account string
+	amount  int
+}
+
+func insertLedgerEntries(ctx context.Context, tx *sqlx.Tx, referenceID string, ride *Ride, entries []ledgerEntry) error {
+	var ownerID string
+	if err := tx.GetContext(ctx, &ownerID, "SELECT owner_id FROM chairs WHERE id = ?", ride.ChairID.String); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// 同じ取引を二重に記録しない
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT IGNORE INTO ledger_entries (reference_id, ride_id, owner_id, chair_id, account, amount) VALUES (?, ?, ?, ?, ?, ?)",
+			referenceID, ride.ID, ownerID, ride.ChairID.String, entry.account, entry.amount,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 完了したライドの運賃を台帳に記録する
+// オーナーの取り分は割引前の運賃から手数料を引いた額で、割引は運営が負担する
+func recordRideLedger(ctx context.Context, tx *sqlx.Tx, ride *Ride) error {
+	rate, err := getCommissionRatePermille(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	sale := calculateSale(*ride)
+	commission := sale * rate / 1000
+	return insertLedgerEntries(ctx, tx, ride.ID, ride, []ledgerEntry{
+		{account: ledgerAccountUserCharge, amount: ride.Fare},
+		{account: ledgerAccountCouponSubsidy, amount: ride.Discount},
+		{account: ledgerAccountPlatformCommission, amount: -commission},
+		{account: ledgerAccountOwnerEarning, amount: -(sale - commission)},
+	})
+}
+
+// 返金した額を売上に換算してオーナーの取り分から差し引く
+// 換算した額と返金額の差は、運営が負担した割引の取り消しになる
+// 手数料も返金した売上の割合だけ取り消す。全額を返金したときに手数料が残らないよう、これまでの返金を含めた割合で求める
+func recordRefundLedger(ctx context.Context, tx *sqlx.Tx, ride *Ride, refund *RideRefund) error {
+	commission := struct {
+		Charged  int `db:"charged"`
+		Reversed int `db:"reversed"`
+	}{}
+	if err := tx.GetContext(
+		ctx,
+		&commission,
+		`SELECT IFNULL(SUM(CASE WHEN reference_id = ? THEN -amount END), 0) AS charged,
+		        IFNULL(SUM(CASE WHEN reference_id != ? THEN amount END), 0) AS reversed
+		 FROM ledger_entries WHERE ride_id = ? AND account = 'PLATFORM_COMMISSION'`,
+		ride.ID, ride.ID, ride.ID,
+	); err != nil {
+		return err
+	}
+	// この返金は SUCCEEDED にした後に呼ばれるので、返金済みの売上に含まれる
+	saleRefunded := 0
+	if err := tx.GetContext(ctx, &saleRefunded, "SELECT IFNULL(SUM(sale_amount), 0) FROM ride_refunds WHERE ride_id = ? AND status = 'SUCCEEDED'", ride.ID); err != nil {
+		return err
+	}
+	commissionReversal := 0
+	if sale := calculateSale(*ride); sale > 0 {
+		commissionReversal = commission.Charged*min(saleRefunded, sale)/sale - commission.Reversed
+	}
+
+	return insertLedgerEntries(ctx, tx, refund.ID, ride, []ledgerEntry{
+		{account: ledgerAccountRefund, amount: -refund.Amount},
+		{account: ledgerAccountCouponSubsidy, amount: -(refund.SaleAmount - refund.Amount)},
+		{account: ledgerAccountPlatformCommission, amount: commissionReversal},
+		{account: ledgerAccountOwnerEarning, amount: refund.SaleAmount - commissionReversal},
+	})
+}
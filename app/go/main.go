@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/kaz/pprotein/integration"
 	"log/slog"
@@ -10,7 +12,11 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -21,11 +27,51 @@ import (
 var db *sqlx.DB
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	go postCoordinateJobWorker()
 
 	mux := setup()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		matchingJobWorker(ctx, getMatchingInterval())
+	}()
+	go func() {
+		defer wg.Done()
+		paymentJobWorker(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		surgeJobWorker(ctx)
+	}()
+
+	server := &http.Server{
+		Addr:    ":8080",
+		Handler: mux,
+		// 通知のストリームはシャットダウン時に閉じたいので、リクエストの context を ctx から派生させる
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("failed to shutdown server", slog.Any("error", err))
+		}
+	}()
+
 	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("failed to listen", slog.Any("error", err))
+	}
+
+	// 実行中のマッチングや決済が終わるのを待つ
+	stop()
+	wg.Wait()
 }
 
 func setup() http.Handler {
@@ -82,7 +128,11 @@ func setup() http.Handler {
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
+		authedMux.HandleFunc("GET /api/app/coupons", appGetCoupons)
+		authedMux.HandleFunc("GET /api/app/invitations", appGetInvitations)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/track", appGetRideTrack)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
@@ -94,6 +144,15 @@ func setup() http.Handler {
 		authedMux := mux.With(ownerAuthMiddleware)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/fleet", ownerGetFleet)
+		authedMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/deactivate", ownerPostChairDeactivate)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/activate", ownerPostChairActivate)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/retire", ownerPostChairRetire)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/token", ownerPostChairToken)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/track", ownerGetChairTrack)
+		authedMux.HandleFunc("POST /api/owner/rides/{ride_id}/refunds", ownerPostRideRefund)
+		authedMux.HandleFunc("GET /api/owner/payouts", ownerGetPayouts)
 	}
 
 	// chair handlers
@@ -105,6 +164,7 @@ func setup() http.Handler {
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
 		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/cancel", chairPostRideCancel)
 	}
 
 	// internal handlers
@@ -112,6 +172,16 @@ func setup() http.Handler {
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
 	}
 
+	// admin handlers
+	{
+		authedMux := mux.With(adminAuthMiddleware)
+		authedMux.HandleFunc("GET /api/admin/payments", adminGetPayments)
+		authedMux.HandleFunc("POST /api/admin/rides/{ride_id}/refunds", adminPostRideRefund)
+		authedMux.HandleFunc("POST /api/admin/campaigns", adminPostCampaigns)
+		authedMux.HandleFunc("GET /api/admin/campaigns", adminGetCampaigns)
+		authedMux.HandleFunc("POST /api/admin/campaigns/{code}/grants", adminPostCampaignGrants)
+	}
+
 	mux.Handle("/debug/*", integration.NewDebugHandler())
 
 	return mux
@@ -181,7 +251,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", slog.Any("error", err))
 }
 
 func secureRandomStr(b int) string {
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+)
+
+// ライドごとに到着時間を比べる椅子の数
+const matchingCandidatesPerRide = 20
+
+type matchingCandidate struct {
+	ride  *Ride
+	chair *Chair
+	// 配車位置に到着するまでにかかる移動回数
+	cost int
+}
+
+// 待機中の全ライドと空いている全椅子を突き合わせ、配車位置までの到着時間が短いペアから順に割り当てる
+// 割り当てたライドの数を返す
+func runMatching(ctx context.Context) (int, error) {
+	rides := []*Ride{}
+	if err := db.SelectContext(ctx, &rides, `
+		SELECT * FROM rides
+		WHERE chair_id IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status = 'CANCELED')
+		ORDER BY created_at
+	`); err != nil {
+		return 0, err
+	}
+	if len(rides) == 0 {
+		return 0, nil
+	}
+
+	chairs := []*Chair{}
+	if err := db.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE is_active = TRUE`); err != nil {
+		return 0, err
+	}
+
+	chairModels := []ChairModel{}
+	if err := db.SelectContext(ctx, &chairModels, `SELECT * FROM chair_models`); err != nil {
+		return 0, err
+	}
+	speedByModel := make(map[string]int, len(chairModels))
+	for _, model := range chairModels {
+		speedByModel[model.Name] = model.Speed
+	}
+
+	// 受諾期限切れで外された椅子は、ライドが他の椅子に割り当てられるまで同じライドに割り当てない
+	skippedChairs := map[string]string{}
+	for _, ride := range rides {
+		skipped, _ := cache.skippedChairs.Get(ctx, ride.ID)
+		if skipped.Found {
+			skippedChairs[ride.ID] = skipped.Value
+		}
+	}
+
+	// 空いていて位置が分かる椅子だけを候補にする
+	freeChairs := map[string]*Chair{}
+	for _, chair := range chairs {
+		activeRides, err := cache.activeRides.Get(ctx, chair.ID)
+		if err != nil {
+			return 0, err
+		}
+		if activeRides.Value != 0 {
+			continue
+		}
+		freeChairs[chair.ID] = chair
+	}
+
+	// ライドごとに索引から近い椅子を数台だけ取り出して組み合わせる
+	// モデルによる速さの違いは数倍程度なので、近い椅子を数台比べれば全ての組み合わせを作らなくてよい
+	candidates := []matchingCandidate{}
+	for _, ride := range rides {
+		pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+		nearest := cache.chairGrid.Nearest(pickup, matchingCandidatesPerRide, func(chairID string) bool {
+			_, ok := freeChairs[chairID]
+			return ok && skippedChairs[ride.ID] != chairID
+		})
+		for _, p := range nearest {
+			chair := freeChairs[p.ChairID]
+			distance := calculateDistance(p.Coordinate.Latitude, p.Coordinate.Longitude, ride.PickupLatitude, ride.PickupLongitude)
+			candidates = append(candidates, matchingCandidate{
+				ride:  ride,
+				chair: chair,
+				cost:  calculateArrivalMoves(distance, speedByModel[chair.Model]),
+			})
+		}
+	}
+
+	// 到着時間が同じなら待たせている時間が長いライドを優先する
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].cost != candidates[j].cost {
+			return candidates[i].cost < candidates[j].cost
+		}
+		return candidates[i].ride.CreatedAt.Before(candidates[j].ride.CreatedAt)
+	})
+
+	matchedRides := map[string]bool{}
+	matchedChairs := map[string]bool{}
+	matched := 0
+	for _, candidate := range candidates {
+		if matchedRides[candidate.ride.ID] || matchedChairs[candidate.chair.ID] {
+			continue
+		}
+
+		// ライドを読んだ後にキャンセルされていたり、椅子を読んだ後に停止や引退していたら割り当てない
+		// 椅子の行は共有ロックで読むので、引退の処理とは椅子の行で順番が決まる
+		result, err := db.ExecContext(ctx, `
+			UPDATE rides SET chair_id = ?, matched_at = CURRENT_TIMESTAMP(6)
+			WHERE id = ? AND chair_id IS NULL AND canceled_at IS NULL
+			  AND EXISTS (SELECT 1 FROM chairs WHERE chairs.id = ? AND chairs.is_active = TRUE AND chairs.retired_at IS NULL)
+		`, candidate.chair.ID, candidate.ride.ID, candidate.chair.ID)
+		if err != nil {
+			return matched, err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return matched, err
+		} else if count == 0 {
+			// 他のマッチングで既に割り当て済みか、キャンセル済みか、椅子が停止している
+			// 椅子が停止しただけならライドは他の候補に割り当てられるので、ライドはまだ割り当て済みにしない
+			continue
+		}
+		matchedRides[candidate.ride.ID] = true
+		matchedChairs[candidate.chair.ID] = true
+		if _, ok := skippedChairs[candidate.ride.ID]; ok {
+			_ = cache.skippedChairs.Delete(ctx, candidate.ride.ID)
+		}
+
+		activeRides, err := cache.activeRides.Get(ctx, candidate.chair.ID)
+		if err != nil {
+			return matched, err
+		}
+		cache.activeRides.Set(ctx, candidate.chair.ID, activeRides.Value+1)
+		matched++
+
+		candidate.ride.ChairID = sql.NullString{String: candidate.chair.ID, Valid: true}
+		publishRideStatusEvents(newRideAssignedEvent(candidate.ride))
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultMatchingInterval = 500 * time.Millisecond
+
+// マッチングが同時に複数走らないようにする
+var matchingMu sync.Mutex
+
+// ISUCON_MATCHING_INTERVAL は秒数 (小数可) または "500ms" のような形式で指定する
+// 0 を指定すると定期実行を無効にする
+func getMatchingInterval() time.Duration {
+	v := os.Getenv("ISUCON_MATCHING_INTERVAL")
+	if v == "" {
+		return defaultMatchingInterval
+	}
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return d
+	}
+	slog.Warn("invalid ISUCON_MATCHING_INTERVAL, fallback to default", slog.String("value", v))
+	return defaultMatchingInterval
+}
+
+// マッチングを1回実行し、所要時間と割り当て数を記録する
+func performMatching(ctx context.Context) (int, error) {
+	matchingMu.Lock()
+	defer matchingMu.Unlock()
+	return performMatchingLocked(ctx)
+}
+
+func performMatchingLocked(ctx context.Context) (int, error) {
+	start := time.Now()
+	requeued, err := requeueUnacceptedRides(ctx, matchingAcceptTimeout)
+	if err != nil {
+		slog.Error("failed to requeue unaccepted rides", slog.Any("error", err))
+		return 0, err
+	}
+	if requeued > 0 {
+		slog.Info("unaccepted rides requeued", slog.Int("requeued", requeued))
+	}
+
+	matched, err := runMatching(ctx)
+	elapsed := time.Since(start)
+	if err != nil {
+		slog.Error("matching failed", slog.Any("error", err), slog.Duration("elapsed", elapsed))
+		return matched, err
+	}
+	// 割り当てが無いパスは数が多いので Debug に落とす
+	level := slog.LevelDebug
+	if matched > 0 {
+		level = slog.LevelInfo
+	}
+	slog.Log(ctx, level, "matching finished", slog.Int("matched", matched), slog.Duration("elapsed", elapsed))
+	return matched, nil
+}
+
+// ctx がキャンセルされるまで一定間隔でマッチングを実行する
+func matchingJobWorker(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("matching job is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// 初期化前はキャッシュが無いのでスキップ
+			if cache == nil {
+				continue
+			}
+			// 前回のマッチングや手動実行が終わっていなければスキップ
+			if !matchingMu.TryLock() {
+				continue
+			}
+			performMatchingLocked(ctx)
+			matchingMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultMatchingAcceptTimeout = 30 * time.Second
+
+// ISUCON_MATCHING_ACCEPT_TIMEOUT は秒数 (小数可) または "30s" のような形式で指定する
+// 0 を指定すると期限切れの検知を無効にする
+func getMatchingAcceptTimeout() time.Duration {
+	v := os.Getenv("ISUCON_MATCHING_ACCEPT_TIMEOUT")
+	if v == "" {
+		return defaultMatchingAcceptTimeout
+	}
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return d
+	}
+	slog.Warn("invalid ISUCON_MATCHING_ACCEPT_TIMEOUT, fallback to default", slog.String("value", v))
+	return defaultMatchingAcceptTimeout
+}
+
+var matchingAcceptTimeout = getMatchingAcceptTimeout()
+
+// 割り当てから timeout 経っても椅子が ENROUTE にしていないライドを、椅子の割り当て前に戻す
+// 戻したライドの数を返す
+func requeueUnacceptedRides(ctx context.Context, timeout time.Duration) (int, error) {
+	if timeout <= 0 {
+		return 0, nil
+	}
+
+	// matched_at は DB の時刻で記録しているので、期限の判定も DB の時刻で行う
+	rideIDs := []string{}
+	if err := db.SelectContext(ctx, &rideIDs, `
+		SELECT id FROM rides
+		WHERE chair_id IS NOT NULL
+		  AND matched_at < CURRENT_TIMESTAMP(6) - INTERVAL ? MICROSECOND
+		  AND (SELECT status FROM ride_statuses WHERE ride_id = rides.id ORDER BY created_at DESC LIMIT 1) = 'MATCHING'
+	`, timeout.Microseconds()); err != nil {
+		return 0, err
+	}
+
+	requeued := 0
+	for _, rideID := range rideIDs {
+		ok, err := requeueUnacceptedRide(ctx, rideID, timeout)
+		if err != nil {
+			return requeued, err
+		}
+		if ok {
+			requeued++
+		}
+	}
+	return requeued, nil
+}
+
+func requeueUnacceptedRide(ctx context.Context, rideID string, timeout time.Duration) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// 椅子の ENROUTE と競合しないようにロックしてから確認し直す
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !ride.ChairID.Valid {
+		return false, nil
+	}
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		return false, err
+	}
+	if status != "MATCHING" {
+		return false, nil
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE rides SET chair_id = NULL, matched_at = NULL WHERE id = ? AND matched_at < CURRENT_TIMESTAMP(6) - INTERVAL ? MICROSECOND",
+		ride.ID, timeout.Microseconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if count == 0 {
+		return false, nil
+	}
+
+	// 次に割り当てる椅子にも MATCHING を通知する
+	if _, err := tx.ExecContext(ctx, "UPDATE ride_statuses SET chair_sent_at = NULL WHERE ride_id = ? AND status = 'MATCHING'", ride.ID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	chairID := ride.ChairID.String
+	activeRides, err := cache.activeRides.Get(ctx, chairID)
+	if err != nil {
+		return false, err
+	}
+	cache.activeRides.Set(ctx, chairID, activeRides.Value-1)
+	cache.skippedChairs.Set(ctx, ride.ID, chairID)
+
+	publishRideStatusEvents(newRideUnassignedEvent(ride))
+
+	slog.Info("ride requeued because chair did not accept it", slog.String("ride_id", ride.ID), slog.String("chair_id", chairID))
+	return true, nil
+}
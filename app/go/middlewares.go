@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"net/http"
+	"os"
+	"strings"
 )
 
 func appAuthMiddleware(next http.Handler) http.Handler {
@@ -76,7 +79,36 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// 引退した椅子のトークンは使えない
+		if chair.RetiredAt.Valid {
+			writeError(w, http.StatusForbidden, errChairRetired)
+			return
+		}
+
 		ctx = context.WithValue(ctx, "chair", chair)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// 管理用 API は Authorization: Bearer ${ISUCON_ADMIN_TOKEN} で認証する
+// ISUCON_ADMIN_TOKEN が設定されていなければ管理用 API は使えない
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := os.Getenv("ISUCON_ADMIN_TOKEN")
+		if adminToken == "" {
+			writeError(w, http.StatusForbidden, errors.New("admin api is disabled"))
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			writeError(w, http.StatusUnauthorized, errors.New("bearer token is required"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -14,6 +14,9 @@ type Chair struct {
 	AccessToken string    `db:"access_token"`
 	CreatedAt   time.Time `db:"created_at"`
 	UpdatedAt   time.Time `db:"updated_at"`
+	// オーナーが停止させた椅子は、椅子自身からは稼働に戻せない
+	OwnerDisabled bool         `db:"owner_disabled"`
+	RetiredAt     sql.NullTime `db:"retired_at"`
 }
 
 type ChairModel struct {
@@ -56,6 +59,13 @@ type Ride struct {
 	DestinationLatitude  int            `db:"destination_latitude"`
 	DestinationLongitude int            `db:"destination_longitude"`
 	Evaluation           *int           `db:"evaluation"`
+	MatchedAt            sql.NullTime   `db:"matched_at"`
+	SurgeMultiplier      int            `db:"surge_multiplier"`
+	BaseFare             int            `db:"base_fare"`
+	MeteredFare          int            `db:"metered_fare"`
+	Discount             int            `db:"discount"`
+	Fare                 int            `db:"fare"`
+	CanceledAt           sql.NullTime   `db:"canceled_at"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
 }
@@ -79,9 +89,69 @@ type Owner struct {
 }
 
 type Coupon struct {
-	UserID    string    `db:"user_id"`
-	Code      string    `db:"code"`
-	Discount  int       `db:"discount"`
-	CreatedAt time.Time `db:"created_at"`
-	UsedBy    *string   `db:"used_by"`
+	UserID       string        `db:"user_id"`
+	Code         string        `db:"code"`
+	Discount     int           `db:"discount"`
+	CreatedAt    time.Time     `db:"created_at"`
+	UsedBy       *string       `db:"used_by"`
+	StartsAt     sql.NullTime  `db:"starts_at"`
+	ExpiresAt    sql.NullTime  `db:"expires_at"`
+	DiscountKind string        `db:"discount_kind"`
+	DiscountCap  sql.NullInt64 `db:"discount_cap"`
+}
+
+type CouponCampaign struct {
+	Code         string        `db:"code"`
+	Discount     int           `db:"discount"`
+	DiscountKind string        `db:"discount_kind"`
+	DiscountCap  sql.NullInt64 `db:"discount_cap"`
+	StartsAt     sql.NullTime  `db:"starts_at"`
+	ExpiresAt    sql.NullTime  `db:"expires_at"`
+	CreatedAt    time.Time     `db:"created_at"`
+}
+
+type PaymentOutbox struct {
+	RideID        string         `db:"ride_id"`
+	UserID        string         `db:"user_id"`
+	Amount        int            `db:"amount"`
+	Status        string         `db:"status"`
+	Attempts      int            `db:"attempts"`
+	NextAttemptAt time.Time      `db:"next_attempt_at"`
+	LastError     sql.NullString `db:"last_error"`
+	CreatedAt     time.Time      `db:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at"`
+}
+
+type RideRefund struct {
+	ID          string    `db:"id"`
+	RideID      string    `db:"ride_id"`
+	Amount      int       `db:"amount"`
+	SaleAmount  int       `db:"sale_amount"`
+	Reason      string    `db:"reason"`
+	RequestKey  string    `db:"request_key"`
+	RequestedBy string    `db:"requested_by"`
+	Status      string    `db:"status"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+type LedgerEntry struct {
+	ID          int64     `db:"id"`
+	ReferenceID string    `db:"reference_id"`
+	RideID      string    `db:"ride_id"`
+	OwnerID     string    `db:"owner_id"`
+	ChairID     string    `db:"chair_id"`
+	Account     string    `db:"account"`
+	Amount      int       `db:"amount"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type ChairSalesHourly struct {
+	ChairID         string    `db:"chair_id"`
+	BucketStart     time.Time `db:"bucket_start"`
+	RideCount       int       `db:"ride_count"`
+	Sales           int       `db:"sales"`
+	FareTotal       int       `db:"fare_total"`
+	EvaluationTotal int       `db:"evaluation_total"`
+	BusyMs          int64     `db:"busy_ms"`
 }
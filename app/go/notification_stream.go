@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const notificationKeepAliveInterval = 15 * time.Second
+
+func isUserRideEvent(userID string) func(RideStatusEvent) bool {
+	return func(event RideStatusEvent) bool {
+		return event.UserID == userID
+	}
+}
+
+func isChairRideEvent(chairID string) func(RideStatusEvent) bool {
+	return func(event RideStatusEvent) bool {
+		return event.ChairID == chairID
+	}
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// filter を満たすイベントが発行されるたびに next を繰り返し呼び、未送信のステータスを Server-Sent Events として順に送る
+// 最初の1回は未送信のものが無くても現在の状態を送る
+func serveNotificationStream[T any](w http.ResponseWriter, r *http.Request, filter func(RideStatusEvent) bool, next func(ctx context.Context) (*T, bool, error)) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+
+	// 取りこぼさないように、最初の読み出しより前に購読しておく
+	// イベントは起こすきっかけとしてだけ使い、送る内容は DB から読み直す
+	wake, unsubscribe := rideStatusEvents.Subscribe(64, filter)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx にバッファさせず、イベントをすぐに届ける
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(notificationKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	first := true
+	for {
+		for {
+			data, sent, err := next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("failed to get notification", slog.Any("error", err))
+				}
+				return
+			}
+			if data != nil && (sent || first) {
+				if err := writeEvent(w, data); err != nil {
+					return
+				}
+			}
+			first = false
+			if !sent {
+				break
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-wake:
+			if !ok {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", buf)
+	return err
+}
+
+// イベント名を付けて送る。受け取る側はイベント名でデータの形を判断する
+func writeNamedEvent(w http.ResponseWriter, name string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, buf)
+	return err
+}
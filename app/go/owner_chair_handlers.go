@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	errChairNotFound      = errors.New("chair not found")
+	errChairRetired       = errors.New("chair is retired")
+	errChairHasActiveRide = errors.New("chair has an active ride")
+)
+
+// オーナーの椅子をロックして取得する。他のオーナーの椅子は存在しないものとして扱う
+func getOwnedChairForUpdate(ctx context.Context, tx *sqlx.Tx, ownerID, chairID string) (*Chair, error) {
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? FOR UPDATE", chairID, ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errChairNotFound
+		}
+		return nil, err
+	}
+	if chair.RetiredAt.Valid {
+		return nil, errChairRetired
+	}
+	return chair, nil
+}
+
+func writeOwnerChairError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errChairNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errChairRetired), errors.Is(err, errChairHasActiveRide):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// オーナーの椅子に対する操作を1つのトランザクションで行う
+func updateOwnedChair(ctx context.Context, ownerID, chairID string, update func(tx *sqlx.Tx, chair *Chair) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	chair, err := getOwnedChairForUpdate(ctx, tx, ownerID, chairID)
+	if err != nil {
+		return err
+	}
+	if err := update(tx, chair); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type ownerPatchChairRequest struct {
+	Name string `json:"name"`
+}
+
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(name) are empty"))
+		return
+	}
+
+	chairID := r.PathValue("chair_id")
+	if err := updateOwnedChair(ctx, owner.ID, chairID, func(tx *sqlx.Tx, chair *Chair) error {
+		_, err := tx.ExecContext(ctx, "UPDATE chairs SET name = ? WHERE id = ?", req.Name, chair.ID)
+		return err
+	}); err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	chairStateEvents.Publish(ChairStateEvent{Kind: ChairEventRenamed, ChairID: chairID, OwnerID: owner.ID, Name: req.Name})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 椅子を停止させ、オーナーが再開するまで椅子自身からは稼働に戻せないようにする
+// 担当中のライドはそのまま続けられる
+func ownerPostChairDeactivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairID := r.PathValue("chair_id")
+	if err := updateOwnedChair(ctx, owner.ID, chairID, func(tx *sqlx.Tx, chair *Chair) error {
+		_, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE, owner_disabled = TRUE WHERE id = ?", chair.ID)
+		return err
+	}); err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	chairStateEvents.Publish(ChairStateEvent{Kind: ChairEventActivity, ChairID: chairID, OwnerID: owner.ID, IsActive: false})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// オーナーによる停止を解除する。稼働に戻すのは椅子自身が行う
+func ownerPostChairActivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	if err := updateOwnedChair(ctx, owner.ID, r.PathValue("chair_id"), func(tx *sqlx.Tx, chair *Chair) error {
+		_, err := tx.ExecContext(ctx, "UPDATE chairs SET owner_disabled = FALSE WHERE id = ?", chair.ID)
+		return err
+	}); err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 椅子を引退させる。引退した椅子は元に戻せず、アクセストークンも使えなくなる
+func ownerPostChairRetire(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairID := r.PathValue("chair_id")
+	if err := updateOwnedChair(ctx, owner.ID, chairID, func(tx *sqlx.Tx, chair *Chair) error {
+		// 担当中のライドを終えてから引退させる
+		// マッチングは椅子の行を読んでから割り当てるので、椅子をロックした後に DB で確かめれば、割り当てられたばかりのライドも見える
+		var hasActiveRide bool
+		if err := tx.GetContext(ctx, &hasActiveRide, `
+			SELECT EXISTS(
+				SELECT 1 FROM rides
+				WHERE chair_id = ?
+				  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status IN ('COMPLETED', 'CANCELED'))
+			)
+		`, chair.ID); err != nil {
+			return err
+		}
+		if hasActiveRide {
+			return errChairHasActiveRide
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE, retired_at = CURRENT_TIMESTAMP(6) WHERE id = ?", chair.ID)
+		return err
+	}); err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	chairStreams.Close(chairID)
+	chairStateEvents.Publish(ChairStateEvent{Kind: ChairEventRetired, ChairID: chairID, OwnerID: owner.ID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPostChairTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// 椅子のアクセストークンを作り直す。古いトークンはすぐに使えなくなる
+func ownerPostChairToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairID := r.PathValue("chair_id")
+	accessToken := secureRandomStr(32)
+	if err := updateOwnedChair(ctx, owner.ID, chairID, func(tx *sqlx.Tx, chair *Chair) error {
+		_, err := tx.ExecContext(ctx, "UPDATE chairs SET access_token = ? WHERE id = ?", accessToken, chair.ID)
+		return err
+	}); err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	// 古いトークンで開いた通知のストリームを閉じる。新しいトークンで接続し直してもらう
+	chairStreams.Close(chairID)
+
+	writeJSON(w, http.StatusOK, &ownerPostChairTokenResponse{
+		AccessToken: accessToken,
+	})
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
@@ -79,26 +81,44 @@ type ownerGetSalesResponse struct {
 	Models     []modelSales `json:"models"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// since と until は UNIX ミリ秒で、省略した場合は期間を制限しない
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		until = time.UnixMilli(parsed)
 	}
+	return since, until, nil
+}
+
+func ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// granularity を指定した場合は、集計テーブルから時系列を返す
+	if granularity := r.URL.Query().Get("granularity"); granularity != "" {
+		if granularity != "hour" && granularity != "day" && granularity != "week" {
+			writeError(w, http.StatusBadRequest, errors.New("granularity must be one of hour, day, week"))
+			return
+		}
+		ownerGetSalesSeries(w, r, r.Context().Value("owner").(*Owner), since, until, granularity)
+		return
+	}
 
 	owner := r.Context().Value("owner").(*Owner)
 
@@ -127,7 +147,14 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sales := sumSales(rides)
+		refunded := 0
+		if err := tx.GetContext(ctx, &refunded, "SELECT IFNULL(SUM(ride_refunds.sale_amount), 0) FROM ride_refunds JOIN rides ON rides.id = ride_refunds.ride_id JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE rides.chair_id = ? AND ride_statuses.status = 'COMPLETED' AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND AND ride_refunds.status = 'SUCCEEDED'", chair.ID, since, until); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// 返金した分は売上から差し引く
+		sales := sumSales(rides) - refunded
 		res.TotalSales += sales
 
 		res.Chairs = append(res.Chairs, chairSales{
@@ -151,6 +178,29 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, res)
 }
 
+// 自分の椅子が担当したライドだけを返金できる
+func ownerPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	handlePostRideRefund(w, r, "owner:"+owner.ID, func(ride *Ride) error {
+		if !ride.ChairID.Valid {
+			return errRideNotFound
+		}
+		chair := &Chair{}
+		if err := db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", ride.ChairID.String); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errRideNotFound
+			}
+			return err
+		}
+		if chair.OwnerID != owner.ID {
+			return errRideNotFound
+		}
+		return nil
+	})
+}
+
 func sumSales(rides []Ride) int {
 	sale := 0
 	for _, ride := range rides {
@@ -159,8 +209,9 @@ func sumSales(rides []Ride) int {
 	return sale
 }
 
+// クーポンの割引は運営が負担するので、オーナーの売上は割引前の運賃になる
 func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	return ride.BaseFare + ride.MeteredFare
 }
 
 type chairWithDetail struct {
@@ -170,6 +221,8 @@ type chairWithDetail struct {
 	AccessToken            string       `db:"access_token"`
 	Model                  string       `db:"model"`
 	IsActive               bool         `db:"is_active"`
+	OwnerDisabled          bool         `db:"owner_disabled"`
+	RetiredAt              sql.NullTime `db:"retired_at"`
 	CreatedAt              time.Time    `db:"created_at"`
 	UpdatedAt              time.Time    `db:"updated_at"`
 	TotalDistance          int          `db:"total_distance"`
@@ -185,6 +238,8 @@ type ownerGetChairResponseChair struct {
 	Name                   string `json:"name"`
 	Model                  string `json:"model"`
 	Active                 bool   `json:"active"`
+	DisabledByOwner        bool   `json:"disabled_by_owner"`
+	RetiredAt              *int64 `json:"retired_at,omitempty"`
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
@@ -201,6 +256,8 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
        access_token,
        model,
        is_active,
+       owner_disabled,
+       retired_at,
        created_at,
        updated_at
 FROM chairs
@@ -222,18 +279,240 @@ WHERE owner_id = ?
 	res := ownerGetChairResponse{}
 	for _, chair := range chairs {
 		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: chair.TotalDistance,
+			ID:              chair.ID,
+			Name:            chair.Name,
+			Model:           chair.Model,
+			Active:          chair.IsActive,
+			DisabledByOwner: chair.OwnerDisabled,
+			RegisteredAt:    chair.CreatedAt.UnixMilli(),
+			TotalDistance:   chair.TotalDistance,
 		}
 		if chair.TotalDistanceUpdatedAt.Valid {
 			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
 			c.TotalDistanceUpdatedAt = &t
 		}
+		if chair.RetiredAt.Valid {
+			t := chair.RetiredAt.Time.UnixMilli()
+			c.RetiredAt = &t
+		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerGetPayoutsResponse struct {
+	Period     string                 `json:"period"`
+	Statements []ownerPayoutStatement `json:"statements"`
+}
+
+// 期間ごとの明細。金額は全て正の値で表す
+type ownerPayoutStatement struct {
+	PeriodStart        int64 `json:"period_start"`
+	PeriodEnd          int64 `json:"period_end"`
+	RideCount          int   `json:"ride_count"`
+	UserCharge         int   `json:"user_charge"`
+	CouponSubsidy      int   `json:"coupon_subsidy"`
+	PlatformCommission int   `json:"platform_commission"`
+	Refund             int   `json:"refund"`
+	OwnerEarning       int   `json:"owner_earning"`
+	// 決済ゲートウェイでの決済の状態ごとのユーザーへの請求額
+	// 決済をワーカーで送るようになる前のライドはどれにも含めない
+	Charged       int `json:"charged"`
+	PendingCharge int `json:"pending_charge"`
+	FailedCharge  int `json:"failed_charge"`
+}
+
+// 取引ごとにまとめた仕訳
+type payoutLine struct {
+	PeriodStart        time.Time
+	ReferenceID        string
+	RideID             string
+	ChairID            string
+	RecordedAt         time.Time
+	UserCharge         int
+	CouponSubsidy      int
+	PlatformCommission int
+	Refund             int
+	OwnerEarning       int
+	// ライドの取引のときだけ決済の状態を持つ
+	PaymentStatus string
+}
+
+func payoutPeriodStart(t time.Time, period string) time.Time {
+	y, m, d := t.Date()
+	switch period {
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case "week":
+		// 月曜始まり
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+func payoutPeriodEnd(start time.Time, period string) time.Time {
+	switch period {
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// 台帳から期間ごとの支払明細を作る。format=csv のときは取引ごとの明細を CSV で返す
+func ownerGetPayouts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "month"
+	}
+	if period != "day" && period != "week" && period != "month" {
+		writeError(w, http.StatusBadRequest, errors.New("period must be one of day, week, month"))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be one of json, csv"))
+		return
+	}
+
+	entries := []LedgerEntry{}
+	if err := db.SelectContext(
+		ctx,
+		&entries,
+		"SELECT * FROM ledger_entries WHERE owner_id = ? AND created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND ORDER BY created_at, id",
+		owner.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	payments := []PaymentOutbox{}
+	if err := db.SelectContext(
+		ctx,
+		&payments,
+		`SELECT payment_outbox.* FROM payment_outbox
+		 WHERE ride_id IN (SELECT ride_id FROM ledger_entries WHERE owner_id = ? AND account = 'USER_CHARGE' AND created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND)`,
+		owner.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	paymentStatusByRide := make(map[string]string, len(payments))
+	for _, payment := range payments {
+		paymentStatusByRide[payment.RideID] = payment.Status
+	}
+
+	lines := []*payoutLine{}
+	lineByReference := map[string]*payoutLine{}
+	for _, entry := range entries {
+		line, ok := lineByReference[entry.ReferenceID]
+		if !ok {
+			line = &payoutLine{
+				PeriodStart: payoutPeriodStart(entry.CreatedAt, period),
+				ReferenceID: entry.ReferenceID,
+				RideID:      entry.RideID,
+				ChairID:     entry.ChairID,
+				RecordedAt:  entry.CreatedAt,
+			}
+			lineByReference[entry.ReferenceID] = line
+			lines = append(lines, line)
+		}
+		// 貸方は負で記録しているので、符号を反転して正の値にする
+		switch entry.Account {
+		case ledgerAccountUserCharge:
+			line.UserCharge += entry.Amount
+			line.PaymentStatus = paymentStatusByRide[entry.RideID]
+			if line.PaymentStatus == "" {
+				line.PaymentStatus = "UNTRACKED"
+			}
+		case ledgerAccountCouponSubsidy:
+			line.CouponSubsidy += entry.Amount
+		case ledgerAccountPlatformCommission:
+			line.PlatformCommission -= entry.Amount
+		case ledgerAccountRefund:
+			line.Refund -= entry.Amount
+		case ledgerAccountOwnerEarning:
+			line.OwnerEarning -= entry.Amount
+		}
+	}
+
+	if format == "csv" {
+		writePayoutsCSV(w, lines)
+		return
+	}
+
+	res := ownerGetPayoutsResponse{
+		Period:     period,
+		Statements: []ownerPayoutStatement{},
+	}
+	var statement *ownerPayoutStatement
+	for _, line := range lines {
+		if statement == nil || statement.PeriodStart != line.PeriodStart.UnixMilli() {
+			res.Statements = append(res.Statements, ownerPayoutStatement{
+				PeriodStart: line.PeriodStart.UnixMilli(),
+				PeriodEnd:   payoutPeriodEnd(line.PeriodStart, period).UnixMilli(),
+			})
+			statement = &res.Statements[len(res.Statements)-1]
+		}
+		if line.ReferenceID == line.RideID {
+			statement.RideCount++
+		}
+		statement.UserCharge += line.UserCharge
+		statement.CouponSubsidy += line.CouponSubsidy
+		statement.PlatformCommission += line.PlatformCommission
+		statement.Refund += line.Refund
+		statement.OwnerEarning += line.OwnerEarning
+		switch line.PaymentStatus {
+		case "SUCCEEDED":
+			statement.Charged += line.UserCharge
+		case "PENDING":
+			statement.PendingCharge += line.UserCharge
+		case "FAILED":
+			statement.FailedCharge += line.UserCharge
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func writePayoutsCSV(w http.ResponseWriter, lines []*payoutLine) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="payouts.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{
+		"period_start", "reference_id", "ride_id", "chair_id", "recorded_at",
+		"user_charge", "coupon_subsidy", "platform_commission", "refund", "owner_earning", "payment_status",
+	})
+	for _, line := range lines {
+		_ = cw.Write([]string{
+			line.PeriodStart.Format(time.DateOnly),
+			line.ReferenceID,
+			line.RideID,
+			line.ChairID,
+			line.RecordedAt.Format(time.RFC3339Nano),
+			strconv.Itoa(line.UserCharge),
+			strconv.Itoa(line.CouponSubsidy),
+			strconv.Itoa(line.PlatformCommission),
+			strconv.Itoa(line.Refund),
+			strconv.Itoa(line.OwnerEarning),
+			line.PaymentStatus,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.Error("failed to write payouts csv", slog.Any("error", err))
+	}
+}
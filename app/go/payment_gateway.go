@@ -12,85 +12,142 @@ import (
 
 var erroredUpstream = errors.New("errored upstream")
 
+// 決済ゲートウェイが応答しなくても、決済の確保期間 (paymentLeaseDuration) が切れる前に諦める
+// 確保期間を過ぎると他のワーカーが同じ決済を送り直してしまう
+const paymentGatewayTimeout = 10 * time.Second
+
+var paymentGatewayClient = &http.Client{Timeout: paymentGatewayTimeout}
+
 type paymentGatewayPostPaymentRequest struct {
 	Amount int `json:"amount"`
 }
 
+type paymentGatewayPostRefundRequest struct {
+	PaymentIdempotencyKey string `json:"payment_idempotency_key"`
+	Amount                int    `json:"amount"`
+}
+
 type paymentGatewayGetPaymentsResponseOne struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	Amount         int                                          `json:"amount"`
+	Status         string                                       `json:"status"`
+	IdempotencyKey string                                       `json:"idempotency_key"`
+	Refunds        []paymentGatewayGetPaymentsResponseOneRefund `json:"refunds"`
+}
+
+type paymentGatewayGetPaymentsResponseOneRefund struct {
+	Amount         int    `json:"amount"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// ライドごとに決済が1回だけ行われるよう、ライドIDから Idempotency-Key を作る
+func paymentIdempotencyKey(rideID string) string {
+	return "ride_" + rideID
 }
 
-func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
+func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
 	b, err := json.Marshal(param)
 	if err != nil {
 		return err
 	}
 
-	// 失敗したらとりあえずリトライ
-	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
-	retry := 0
-	for {
-		err := func() error {
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+token)
+	// リトライは決済のアウトボックスに任せる
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	res, err := paymentGatewayClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
 
-			res, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
+	if res.StatusCode != http.StatusNoContent {
+		// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
+		payments, err := requestPaymentGatewayGetPayments(ctx, paymentGatewayURL, token)
+		if err != nil {
+			return err
+		}
+
+		// 同じ Idempotency-Key の決済が記録されていれば成功している
+		for _, payment := range payments {
+			if payment.IdempotencyKey == idempotencyKey {
+				return nil
 			}
-			defer res.Body.Close()
+		}
+		return fmt.Errorf("payment for %s is not recorded (status code %d). %w", idempotencyKey, res.StatusCode, erroredUpstream)
+	}
 
-			if res.StatusCode != http.StatusNoContent {
-				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
-				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
-				if err != nil {
-					return err
-				}
-				getReq.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
 
-				getRes, err := http.DefaultClient.Do(getReq)
-				if err != nil {
-					return err
-				}
-				defer res.Body.Close()
+func requestPaymentGatewayGetPayments(ctx context.Context, paymentGatewayURL string, token string) ([]paymentGatewayGetPaymentsResponseOne, error) {
+	getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+	getReq.Header.Set("Authorization", "Bearer "+token)
 
-				// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
-				if getRes.StatusCode != http.StatusOK {
-					return fmt.Errorf("[GET /payments] unexpected status code (%d)", getRes.StatusCode)
-				}
-				var payments []paymentGatewayGetPaymentsResponseOne
-				if err := json.NewDecoder(getRes.Body).Decode(&payments); err != nil {
-					return err
-				}
+	getRes, err := paymentGatewayClient.Do(getReq)
+	if err != nil {
+		return nil, err
+	}
+	defer getRes.Body.Close()
 
-				rides, err := retrieveRidesOrderByCreatedAtAsc()
-				if err != nil {
-					return err
-				}
+	// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
+	if getRes.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[GET /payments] unexpected status code (%d)", getRes.StatusCode)
+	}
+	var payments []paymentGatewayGetPaymentsResponseOne
+	if err := json.NewDecoder(getRes.Body).Decode(&payments); err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
 
-				if len(rides) != len(payments) {
-					return fmt.Errorf("unexpected number of payments: %d != %d. %w", len(rides), len(payments), erroredUpstream)
-				}
+func requestPaymentGatewayPostRefund(ctx context.Context, paymentGatewayURL string, token string, idempotencyKey string, param *paymentGatewayPostRefundRequest) error {
+	b, err := json.Marshal(param)
+	if err != nil {
+		return err
+	}
 
-				return nil
-			}
-			return nil
-		}()
+	// 決済と同じく1回だけ送る。失敗した返金は同じ Idempotency-Key の返金要求で送り直す
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/refunds", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	res, err := paymentGatewayClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
+		payments, err := requestPaymentGatewayGetPayments(ctx, paymentGatewayURL, token)
 		if err != nil {
-			if retry < 5 {
-				retry++
-				time.Sleep(100 * time.Millisecond)
+			return err
+		}
+
+		// 同じ Idempotency-Key の返金が記録されていれば成功している
+		for _, payment := range payments {
+			if payment.IdempotencyKey != param.PaymentIdempotencyKey {
 				continue
-			} else {
-				return err
+			}
+			for _, refund := range payment.Refunds {
+				if refund.IdempotencyKey == idempotencyKey {
+					return nil
+				}
 			}
 		}
-		break
+		return fmt.Errorf("refund for %s is not recorded (status code %d). %w", idempotencyKey, res.StatusCode, erroredUpstream)
 	}
 
 	return nil
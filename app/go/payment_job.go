@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	paymentJobInterval = 1 * time.Second
+	// 送信中の決済を他のワーカーが拾わないようにする時間
+	paymentLeaseDuration = 1 * time.Minute
+	paymentMaxAttempts   = 10
+	paymentBaseBackoff   = 1 * time.Second
+	paymentMaxBackoff    = 5 * time.Minute
+	paymentBatchSize     = 100
+)
+
+var paymentJobWakeChan = make(chan struct{}, 1)
+
+// ライドの完了と同じトランザクションで決済を登録する
+func enqueuePayment(ctx context.Context, tx *sqlx.Tx, ride *Ride, amount int) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO payment_outbox (ride_id, user_id, amount) VALUES (?, ?, ?)",
+		ride.ID, ride.UserID, amount,
+	)
+	return err
+}
+
+// 次の実行を待たずに決済を送信させる
+func wakePaymentJobWorker() {
+	select {
+	case paymentJobWakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// ctx がキャンセルされるまで、送信待ちの決済を決済ゲートウェイに送る
+func paymentJobWorker(ctx context.Context) {
+	ticker := time.NewTicker(paymentJobInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-paymentJobWakeChan:
+		}
+
+		if err := processDuePayments(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("failed to process payments", slog.Any("error", err))
+		}
+	}
+}
+
+func processDuePayments(ctx context.Context) error {
+	payments := []PaymentOutbox{}
+	if err := db.SelectContext(
+		ctx,
+		&payments,
+		"SELECT * FROM payment_outbox WHERE status = 'PENDING' AND next_attempt_at <= CURRENT_TIMESTAMP(6) ORDER BY created_at LIMIT ?",
+		paymentBatchSize,
+	); err != nil {
+		return err
+	}
+
+	for _, payment := range payments {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// 複数台で動かしても二重に送らないように、送信前に確保する
+		result, err := db.ExecContext(
+			ctx,
+			"UPDATE payment_outbox SET next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND WHERE ride_id = ? AND status = 'PENDING' AND next_attempt_at <= CURRENT_TIMESTAMP(6)",
+			paymentLeaseDuration.Microseconds(), payment.RideID,
+		)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			continue
+		}
+
+		if err := deliverPayment(ctx, &payment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 決済を1件送信し、結果を記録する
+// 決済ゲートウェイのエラーは記録して再送を予約し、DB のエラーだけを返す
+func deliverPayment(ctx context.Context, payment *PaymentOutbox) error {
+	attempts := payment.Attempts + 1
+	sendErr := sendPayment(ctx, payment)
+	if sendErr == nil {
+		_, err := db.ExecContext(
+			ctx,
+			"UPDATE payment_outbox SET status = 'SUCCEEDED', attempts = ?, last_error = NULL WHERE ride_id = ?",
+			attempts, payment.RideID,
+		)
+		return err
+	}
+
+	if attempts >= paymentMaxAttempts {
+		slog.Error("payment failed permanently", slog.String("ride_id", payment.RideID), slog.Any("error", sendErr))
+		_, err := db.ExecContext(
+			ctx,
+			"UPDATE payment_outbox SET status = 'FAILED', attempts = ?, last_error = ? WHERE ride_id = ?",
+			attempts, sendErr.Error(), payment.RideID,
+		)
+		return err
+	}
+
+	backoff := paymentBackoff(attempts)
+	slog.Warn("payment failed, will retry", slog.String("ride_id", payment.RideID), slog.Int("attempts", attempts), slog.Duration("backoff", backoff), slog.Any("error", sendErr))
+	_, err := db.ExecContext(
+		ctx,
+		"UPDATE payment_outbox SET attempts = ?, last_error = ?, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND WHERE ride_id = ?",
+		attempts, sendErr.Error(), backoff.Microseconds(), payment.RideID,
+	)
+	return err
+}
+
+// attempts 回目の失敗の後に待つ時間。1秒から倍々に増やし、5分で頭打ちにする
+func paymentBackoff(attempts int) time.Duration {
+	backoff := paymentBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= paymentMaxBackoff {
+			return paymentMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func sendPayment(ctx context.Context, payment *PaymentOutbox) error {
+	paymentToken := &PaymentToken{}
+	if err := db.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, payment.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("payment token not registered")
+		}
+		return err
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+
+	return requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentIdempotencyKey(payment.RideID), &paymentGatewayPostPaymentRequest{
+		Amount: payment.Amount,
+	})
+}
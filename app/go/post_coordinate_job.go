@@ -64,6 +64,7 @@ func performPostCoordinate(data *PostCoordinateJobData) {
 	updateTotalDistanceCache(ctx, lastLocation, location)
 
 	ride := &Ride{}
+	var events []RideStatusEvent
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			slog.Error(err.Error())
@@ -75,20 +76,20 @@ func performPostCoordinate(data *PostCoordinateJobData) {
 			slog.Error(err.Error())
 			return
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if latitude == ride.PickupLatitude && longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					slog.Error(err.Error())
-					return
-				}
-			}
-
-			if latitude == ride.DestinationLatitude && longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					slog.Error(err.Error())
-					return
-				}
+		// 配車位置・目的地に到着したら状態を進める
+		next := ""
+		if latitude == ride.PickupLatitude && longitude == ride.PickupLongitude && rideStates.CanTransition(ride, status, "PICKUP", rideActorSystem) {
+			next = "PICKUP"
+		} else if latitude == ride.DestinationLatitude && longitude == ride.DestinationLongitude && rideStates.CanTransition(ride, status, "ARRIVED", rideActorSystem) {
+			next = "ARRIVED"
+		}
+		if next != "" {
+			event, err := insertRideStatus(ctx, tx, ride, status, next, rideActorSystem)
+			if err != nil {
+				slog.Error(err.Error())
+				return
 			}
+			events = append(events, event)
 		}
 	}
 
@@ -96,4 +97,7 @@ func performPostCoordinate(data *PostCoordinateJobData) {
 		slog.Error(err.Error())
 		return
 	}
+
+	publishChairLocationEvent(location)
+	publishRideStatusEvents(events...)
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	errPaymentNotSucceeded  = errors.New("payment for this ride has not succeeded")
+	errRefundExceedsPayment = errors.New("refund amount exceeds the remaining payment")
+)
+
+type postRideRefundRequest struct {
+	// 省略した場合は返金されていない残額を全て返金する
+	Amount *int   `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type postRideRefundResponse struct {
+	ID        string `json:"id"`
+	RideID    string `json:"ride_id"`
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// owner と admin の返金 API の共通部分
+// authorize で呼び出し元がこのライドを返金できるかを検証する
+func handlePostRideRefund(w http.ResponseWriter, r *http.Request, requestedBy string, authorize func(ride *Ride) error) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	requestKey := r.Header.Get("Idempotency-Key")
+	if requestKey == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Idempotency-Key header is required"))
+		return
+	}
+
+	req := &postRideRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(reason) are empty"))
+		return
+	}
+	if req.Amount != nil && *req.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("amount must be positive"))
+		return
+	}
+
+	ride := &Ride{}
+	if err := db.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errRideNotFound)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := authorize(ride); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	refund, err := refundRide(ctx, ride, req.Amount, req.Reason, requestKey, requestedBy)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPaymentNotSucceeded):
+			writeError(w, http.StatusConflict, err)
+		case errors.Is(err, errRefundExceedsPayment):
+			writeError(w, http.StatusBadRequest, err)
+		case refund != nil:
+			// 記録はできたが決済ゲートウェイへの返金に失敗した
+			writeError(w, http.StatusBadGateway, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &postRideRefundResponse{
+		ID:        refund.ID,
+		RideID:    refund.RideID,
+		Amount:    refund.Amount,
+		Reason:    refund.Reason,
+		Status:    refund.Status,
+		CreatedAt: refund.CreatedAt.UnixMilli(),
+	})
+}
+
+// ライドの決済を返金する。amount が nil なら残額を全て返金する
+// 同じ requestKey の返金は1回しか行わず、記録済みのものを返す。前回失敗していれば送り直す
+// 返金を記録した後に決済ゲートウェイへの送信に失敗した場合は、記録した返金とエラーの両方を返す
+func refundRide(ctx context.Context, ride *Ride, amount *int, reason, requestKey, requestedBy string) (*RideRefund, error) {
+	refund, err := reserveRefund(ctx, ride, amount, reason, requestKey, requestedBy)
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status == "SUCCEEDED" {
+		return refund, nil
+	}
+
+	sendErr := sendRefund(ctx, ride, refund)
+	refund.Status = "SUCCEEDED"
+	if sendErr != nil {
+		refund.Status = "FAILED"
+	}
+	if err := finishRefund(ctx, ride, refund); err != nil {
+		return refund, err
+	}
+	// 同時に送った他の要求が成功を記録していれば成功とする
+	if refund.Status == "SUCCEEDED" {
+		return refund, nil
+	}
+	return refund, sendErr
+}
+
+// 返金の結果を記録する。返金できた分は同じトランザクションで台帳と売上の集計にも反映する
+// 同じ返金を同時に送った場合は、先に記録した方の結果を使い、台帳と集計には1回だけ反映する
+func finishRefund(ctx context.Context, ride *Ride, refund *RideRefund) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE ride_refunds SET status = ? WHERE id = ? AND status = 'PENDING'", refund.Status, refund.ID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return tx.GetContext(ctx, &refund.Status, "SELECT status FROM ride_refunds WHERE id = ?", refund.ID)
+	}
+	if refund.Status == "SUCCEEDED" {
+		if err := recordRefundLedger(ctx, tx, ride, refund); err != nil {
+			return err
+		}
+		if err := recordRefundAggregate(ctx, tx, ride, refund.SaleAmount); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 返金を PENDING で記録する。決済済みの額を超えないように決済をロックして確認する
+func reserveRefund(ctx context.Context, ride *Ride, amount *int, reason, requestKey, requestedBy string) (*RideRefund, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	payment := &PaymentOutbox{}
+	if err := tx.GetContext(ctx, payment, "SELECT * FROM payment_outbox WHERE ride_id = ? FOR UPDATE", ride.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errPaymentNotSucceeded
+		}
+		return nil, err
+	}
+	if payment.Status != "SUCCEEDED" {
+		return nil, errPaymentNotSucceeded
+	}
+
+	refund := &RideRefund{}
+	found := true
+	if err := tx.GetContext(ctx, refund, "SELECT * FROM ride_refunds WHERE ride_id = ? AND request_key = ?", ride.ID, requestKey); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		found = false
+	}
+	if found && refund.Status != "FAILED" {
+		return refund, nil
+	}
+
+	// 失敗した返金は返金済みに数えない
+	refunded := struct {
+		Amount     int `db:"amount"`
+		SaleAmount int `db:"sale_amount"`
+	}{}
+	if err := tx.GetContext(ctx, &refunded, "SELECT IFNULL(SUM(amount), 0) AS amount, IFNULL(SUM(sale_amount), 0) AS sale_amount FROM ride_refunds WHERE ride_id = ? AND status != 'FAILED'", ride.ID); err != nil {
+		return nil, err
+	}
+	remaining := payment.Amount - refunded.Amount
+
+	if found {
+		// 前回失敗した返金を送り直す
+		if refund.Amount > remaining {
+			return nil, fmt.Errorf("%w: remaining %d", errRefundExceedsPayment, remaining)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE ride_refunds SET status = 'PENDING' WHERE id = ?", refund.ID); err != nil {
+			return nil, err
+		}
+	} else {
+		refundAmount := remaining
+		if amount != nil {
+			refundAmount = *amount
+		}
+		if refundAmount <= 0 || refundAmount > remaining {
+			return nil, fmt.Errorf("%w: remaining %d", errRefundExceedsPayment, remaining)
+		}
+		saleAmount := calculateRefundSaleAmount(ride, payment.Amount, refundAmount, remaining, refunded.SaleAmount)
+		refundID := ulid.Make().String()
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO ride_refunds (id, ride_id, amount, sale_amount, reason, request_key, requested_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			refundID, ride.ID, refundAmount, saleAmount, reason, requestKey, requestedBy,
+		); err != nil {
+			return nil, err
+		}
+		if err := tx.GetContext(ctx, refund, "SELECT * FROM ride_refunds WHERE id = ?", refundID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	refund.Status = "PENDING"
+	return refund, nil
+}
+
+// 返金額は割引後の請求額なので、売上 (割引前の運賃) から差し引く額に換算する
+// 残額を全て返金するときは端数が残らないように、売上のうちまだ差し引いていない分を全て差し引く
+func calculateRefundSaleAmount(ride *Ride, paid, amount, remaining, saleRefunded int) int {
+	sale := calculateSale(*ride)
+	if amount == remaining {
+		return sale - saleRefunded
+	}
+	return sale * amount / paid
+}
+
+func sendRefund(ctx context.Context, ride *Ride, refund *RideRefund) error {
+	paymentToken := &PaymentToken{}
+	if err := db.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
+		return err
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+
+	return requestPaymentGatewayPostRefund(ctx, paymentGatewayURL, paymentToken.Token, "refund_"+refund.ID, &paymentGatewayPostRefundRequest{
+		PaymentIdempotencyKey: paymentIdempotencyKey(ride.ID),
+		Amount:                refund.Amount,
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+var (
+	errRideNotFound    = errors.New("ride not found")
+	errRideNotAssigned = errors.New("not assigned to this ride")
+)
+
+// ライドをキャンセルし、使ったクーポンを返却する
+// authorize で呼び出し元がこのライドを操作できるかを検証する
+func cancelRide(ctx context.Context, rideID string, actor rideActor, authorize func(ride *Ride) error) (*Ride, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errRideNotFound
+		}
+		return nil, err
+	}
+	if err := authorize(ride); err != nil {
+		return nil, err
+	}
+
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := insertRideStatus(ctx, tx, ride, status, "CANCELED", actor)
+	if err != nil {
+		return nil, err
+	}
+
+	// 同時に走っているマッチングが割り当てないように、ライドの行にも印を付ける
+	if _, err := tx.ExecContext(ctx, "UPDATE rides SET canceled_at = CURRENT_TIMESTAMP(6) WHERE id = ?", ride.ID); err != nil {
+		return nil, err
+	}
+
+	// クーポンは未使用に戻す
+	if _, err := tx.ExecContext(ctx, "UPDATE coupons SET used_by = NULL WHERE used_by = ?", ride.ID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if ride.ChairID.Valid {
+		activeRides, err := cache.activeRides.Get(ctx, ride.ChairID.String)
+		if err != nil {
+			return nil, err
+		}
+		cache.activeRides.Set(ctx, ride.ChairID.String, activeRides.Value-1)
+	}
+
+	publishRideStatusEvents(event)
+
+	return ride, nil
+}
+
+func writeCancelRideError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errRideNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, errRideNotAssigned) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeRideStatusError(w, err)
+}
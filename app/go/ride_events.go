@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// ライドのイベントの種類
+type RideEventKind string
+
+const (
+	// 状態遷移1回分。ride_statuses の1行に対応する
+	RideEventTransition RideEventKind = "TRANSITION"
+	// 椅子が割り当てられた。状態は変わらないので、状態遷移を数える購読者は無視する
+	RideEventAssigned RideEventKind = "ASSIGNED"
+	// 受諾期限切れで椅子の割り当てを外された。ChairID は外された椅子
+	RideEventUnassigned RideEventKind = "UNASSIGNED"
+)
+
+// ライドのイベント。Status は状態遷移なら遷移後の状態、それ以外ならその時点の状態
+type RideStatusEvent struct {
+	Kind      RideEventKind
+	RideID    string
+	UserID    string
+	ChairID   string
+	Status    string
+	CreatedAt time.Time
+}
+
+var rideStatusEvents = NewEventBus[RideStatusEvent]()
+
+func newRideStatusEvent(ride *Ride, status string) RideStatusEvent {
+	return RideStatusEvent{
+		Kind:      RideEventTransition,
+		RideID:    ride.ID,
+		UserID:    ride.UserID,
+		ChairID:   ride.ChairID.String,
+		Status:    status,
+		CreatedAt: time.Now(),
+	}
+}
+
+// current から status への遷移を検証して ride_statuses に1行追加し、コミット後に発行するイベントを返す
+// 遷移できない場合は *rideTransitionError を返す
+func insertRideStatus(ctx context.Context, tx *sqlx.Tx, ride *Ride, current, status string, actor rideActor) (RideStatusEvent, error) {
+	if err := rideStates.Validate(ride, current, status, actor); err != nil {
+		return RideStatusEvent{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, status); err != nil {
+		return RideStatusEvent{}, err
+	}
+	return newRideStatusEvent(ride, status), nil
+}
+
+// 椅子への通知のため、割り当て先の椅子を入れて発行する
+func newRideAssignedEvent(ride *Ride) RideStatusEvent {
+	event := newRideStatusEvent(ride, "MATCHING")
+	event.Kind = RideEventAssigned
+	return event
+}
+
+// ride.ChairID は外す前の椅子のまま渡す
+func newRideUnassignedEvent(ride *Ride) RideStatusEvent {
+	event := newRideStatusEvent(ride, "MATCHING")
+	event.Kind = RideEventUnassigned
+	return event
+}
+
+func publishRideStatusEvents(events ...RideStatusEvent) {
+	for _, event := range events {
+		rideStatusEvents.Publish(event)
+	}
+}
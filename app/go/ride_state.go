@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// ライドの状態を変更する主体
+type rideActor string
+
+const (
+	rideActorApp    rideActor = "app"
+	rideActorChair  rideActor = "chair"
+	rideActorSystem rideActor = "system"
+)
+
+type rideTransition struct {
+	from   string
+	to     string
+	actors []rideActor
+	// 遷移の前提条件。満たさない場合は理由を返す
+	guard func(ride *Ride) error
+}
+
+type rideStateMachine struct {
+	// from -> to -> transition
+	transitions map[string]map[string]rideTransition
+}
+
+// 遷移できない状態変更を要求されたときのエラー
+type rideTransitionError struct {
+	Current   string
+	Requested string
+	Reason    string
+}
+
+func (e *rideTransitionError) Error() string {
+	current := e.Current
+	if current == "" {
+		current = "(none)"
+	}
+	return fmt.Sprintf("cannot change ride status from %s to %s: %s", current, e.Requested, e.Reason)
+}
+
+func newRideStateMachine(transitions []rideTransition) *rideStateMachine {
+	m := &rideStateMachine{transitions: map[string]map[string]rideTransition{}}
+	for _, t := range transitions {
+		if _, ok := m.transitions[t.from]; !ok {
+			m.transitions[t.from] = map[string]rideTransition{}
+		}
+		m.transitions[t.from][t.to] = t
+	}
+	return m
+}
+
+func requireChairAssigned(ride *Ride) error {
+	if !ride.ChairID.Valid {
+		return errors.New("chair is not assigned")
+	}
+	return nil
+}
+
+// ライドの状態遷移の定義。ここに無い遷移は全て不正
+// 作成直後のライドの状態は空文字列として扱う
+var rideStates = newRideStateMachine([]rideTransition{
+	{from: "", to: "MATCHING", actors: []rideActor{rideActorApp}},
+	{from: "MATCHING", to: "ENROUTE", actors: []rideActor{rideActorChair}, guard: requireChairAssigned},
+	{from: "ENROUTE", to: "PICKUP", actors: []rideActor{rideActorSystem}},
+	{from: "PICKUP", to: "CARRYING", actors: []rideActor{rideActorChair}},
+	{from: "CARRYING", to: "ARRIVED", actors: []rideActor{rideActorSystem}},
+	{from: "ARRIVED", to: "COMPLETED", actors: []rideActor{rideActorApp}},
+	// 乗車前であればキャンセルできる。椅子は自分が引き受けたライドだけキャンセルできる
+	{from: "MATCHING", to: "CANCELED", actors: []rideActor{rideActorApp}},
+	{from: "ENROUTE", to: "CANCELED", actors: []rideActor{rideActorApp, rideActorChair}},
+	{from: "PICKUP", to: "CANCELED", actors: []rideActor{rideActorApp, rideActorChair}},
+})
+
+// これ以上状態が変わらないかどうか
+func isRideFinished(status string) bool {
+	return status == "COMPLETED" || status == "CANCELED"
+}
+
+// current から requested への遷移を actor が行えるかを検証する
+func (m *rideStateMachine) Validate(ride *Ride, current, requested string, actor rideActor) error {
+	t, ok := m.transitions[current][requested]
+	if !ok {
+		return &rideTransitionError{Current: current, Requested: requested, Reason: "transition is not allowed"}
+	}
+	if !slices.Contains(t.actors, actor) {
+		return &rideTransitionError{Current: current, Requested: requested, Reason: fmt.Sprintf("%s cannot make this transition", actor)}
+	}
+	if t.guard != nil {
+		if err := t.guard(ride); err != nil {
+			return &rideTransitionError{Current: current, Requested: requested, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+func (m *rideStateMachine) CanTransition(ride *Ride, current, requested string, actor rideActor) bool {
+	return m.Validate(ride, current, requested, actor) == nil
+}
+
+// 状態遷移のエラーなら 409、それ以外なら 500 を返す
+func writeRideStatusError(w http.ResponseWriter, err error) {
+	var transitionErr *rideTransitionError
+	if errors.As(err, &transitionErr) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
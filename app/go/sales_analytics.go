@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 完了したライドを椅子ごと・1時間ごとの集計に加える
+// 椅子の稼働時間は、椅子を割り当ててから完了するまでを完了した時間帯に数える
+func recordChairSalesAggregate(ctx context.Context, tx *sqlx.Tx, ride *Ride) error {
+	busySince := ride.CreatedAt
+	if ride.MatchedAt.Valid {
+		busySince = ride.MatchedAt.Time
+	}
+	evaluation := 0
+	if ride.Evaluation != nil {
+		evaluation = *ride.Evaluation
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_hourly (chair_id, bucket_start, ride_count, sales, fare_total, evaluation_total, busy_ms)
+		 VALUES (?, DATE_FORMAT(CURRENT_TIMESTAMP(6), '%Y-%m-%d %H:00:00'), 1, ?, ?, ?, GREATEST(TIMESTAMPDIFF(MICROSECOND, ?, CURRENT_TIMESTAMP(6)) DIV 1000, 0))
+		 ON DUPLICATE KEY UPDATE
+		   ride_count = ride_count + VALUES(ride_count),
+		   sales = sales + VALUES(sales),
+		   fare_total = fare_total + VALUES(fare_total),
+		   evaluation_total = evaluation_total + VALUES(evaluation_total),
+		   busy_ms = busy_ms + VALUES(busy_ms)`,
+		ride.ChairID.String, calculateSale(*ride), ride.Fare, evaluation, busySince,
+	)
+	return err
+}
+
+// 返金した額を、ライドが完了した時間帯の売上から差し引く
+func recordRefundAggregate(ctx context.Context, tx *sqlx.Tx, ride *Ride, amount int) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`UPDATE chair_sales_hourly
+		 SET sales = sales - ?
+		 WHERE chair_id = ?
+		   AND bucket_start = (SELECT DATE_FORMAT(created_at, '%Y-%m-%d %H:00:00') FROM ledger_entries WHERE reference_id = ? AND account = 'USER_CHARGE')`,
+		amount, ride.ChairID.String, ride.ID,
+	)
+	return err
+}
+
+type ownerGetSalesSeriesResponse struct {
+	Granularity string             `json:"granularity"`
+	TotalSales  int                `json:"total_sales"`
+	Chairs      []chairSalesSeries `json:"chairs"`
+	Models      []modelSalesSeries `json:"models"`
+}
+
+type chairSalesSeries struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Sales  int               `json:"sales"`
+	Series []salesSeriesItem `json:"series"`
+}
+
+type modelSalesSeries struct {
+	Model  string            `json:"model"`
+	Sales  int               `json:"sales"`
+	Series []salesSeriesItem `json:"series"`
+}
+
+// ライドが完了した区間だけを返す
+type salesSeriesItem struct {
+	BucketStart       int64   `json:"bucket_start"`
+	Sales             int     `json:"sales"`
+	RideCount         int     `json:"ride_count"`
+	AverageFare       float64 `json:"average_fare"`
+	AverageEvaluation float64 `json:"average_evaluation"`
+	// 区間のうち椅子がライドを担当していた時間の割合
+	Utilization float64 `json:"utilization"`
+}
+
+type salesBucket struct {
+	start           time.Time
+	sales           int
+	rideCount       int
+	fareTotal       int
+	evaluationTotal int
+	busyMs          int64
+	// 稼働率の分母になる椅子の数
+	chairCount int
+}
+
+func (b *salesBucket) add(row ChairSalesHourly) {
+	b.sales += row.Sales
+	b.rideCount += row.RideCount
+	b.fareTotal += row.FareTotal
+	b.evaluationTotal += row.EvaluationTotal
+	b.busyMs += row.BusyMs
+}
+
+func salesBucketStart(t time.Time, granularity string) time.Time {
+	y, m, d := t.Date()
+	switch granularity {
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case "week":
+		// 月曜始まり
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	}
+}
+
+func salesBucketDuration(granularity string) time.Duration {
+	switch granularity {
+	case "day":
+		return 24 * time.Hour
+	case "week":
+		return 7 * 24 * time.Hour
+	default:
+		return time.Hour
+	}
+}
+
+func toSalesSeries(buckets map[time.Time]*salesBucket, granularity string) []salesSeriesItem {
+	series := make([]salesSeriesItem, 0, len(buckets))
+	for _, b := range buckets {
+		item := salesSeriesItem{
+			BucketStart: b.start.UnixMilli(),
+			Sales:       b.sales,
+			RideCount:   b.rideCount,
+		}
+		if b.rideCount > 0 {
+			item.AverageFare = float64(b.fareTotal) / float64(b.rideCount)
+			item.AverageEvaluation = float64(b.evaluationTotal) / float64(b.rideCount)
+		}
+		if b.chairCount > 0 {
+			item.Utilization = min(float64(b.busyMs)/float64(salesBucketDuration(granularity).Milliseconds()*int64(b.chairCount)), 1)
+		}
+		series = append(series, item)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].BucketStart < series[j].BucketStart
+	})
+	return series
+}
+
+// 1時間ごとの集計から、椅子ごと・モデルごとの時系列を作る
+// 集計は時間単位なので、since と until を含む時間帯全体を対象にする
+func ownerGetSalesSeries(w http.ResponseWriter, r *http.Request, owner *Owner, since, until time.Time, granularity string) {
+	ctx := r.Context()
+
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ? ORDER BY created_at", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rows := []ChairSalesHourly{}
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT chair_sales_hourly.* FROM chair_sales_hourly
+		 JOIN chairs ON chairs.id = chair_sales_hourly.chair_id
+		 WHERE chairs.owner_id = ?
+		   AND bucket_start BETWEEN DATE_FORMAT(?, '%Y-%m-%d %H:00:00') AND ?`,
+		owner.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chairBuckets := map[string]map[time.Time]*salesBucket{}
+	modelBuckets := map[string]map[time.Time]*salesBucket{}
+	modelChairCount := map[string]int{}
+	modelByChair := map[string]string{}
+	for _, chair := range chairs {
+		chairBuckets[chair.ID] = map[time.Time]*salesBucket{}
+		if _, ok := modelBuckets[chair.Model]; !ok {
+			modelBuckets[chair.Model] = map[time.Time]*salesBucket{}
+		}
+		modelChairCount[chair.Model]++
+		modelByChair[chair.ID] = chair.Model
+	}
+
+	res := ownerGetSalesSeriesResponse{
+		Granularity: granularity,
+		Chairs:      []chairSalesSeries{},
+		Models:      []modelSalesSeries{},
+	}
+	for _, row := range rows {
+		start := salesBucketStart(row.BucketStart, granularity)
+		res.TotalSales += row.Sales
+
+		cb, ok := chairBuckets[row.ChairID][start]
+		if !ok {
+			cb = &salesBucket{start: start, chairCount: 1}
+			chairBuckets[row.ChairID][start] = cb
+		}
+		cb.add(row)
+
+		model := modelByChair[row.ChairID]
+		mb, ok := modelBuckets[model][start]
+		if !ok {
+			mb = &salesBucket{start: start, chairCount: modelChairCount[model]}
+			modelBuckets[model][start] = mb
+		}
+		mb.add(row)
+	}
+
+	for _, chair := range chairs {
+		series := toSalesSeries(chairBuckets[chair.ID], granularity)
+		sales := 0
+		for _, item := range series {
+			sales += item.Sales
+		}
+		res.Chairs = append(res.Chairs, chairSalesSeries{
+			ID:     chair.ID,
+			Name:   chair.Name,
+			Sales:  sales,
+			Series: series,
+		})
+	}
+	for model, buckets := range modelBuckets {
+		series := toSalesSeries(buckets, granularity)
+		sales := 0
+		for _, item := range series {
+			sales += item.Sales
+		}
+		res.Models = append(res.Models, modelSalesSeries{
+			Model:  model,
+			Sales:  sales,
+			Series: series,
+		})
+	}
+	sort.Slice(res.Models, func(i, j int) bool {
+		return res.Models[i].Model < res.Models[j].Model
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// 需要と供給を数える区画の一辺の長さ
+	surgeCellSize = 100
+	// 倍率は千分率で扱う。1000 が等倍
+	surgeBaseMultiplier = 1000
+	surgeMaxMultiplier  = 2000
+	// 倍率を 0.1 刻みにして、見積もりと配車要求の間で細かく変わらないようにする
+	surgeMultiplierStep = 100
+	// 区画ごとの倍率を計算し直す間隔
+	surgeRefreshInterval = 1 * time.Second
+)
+
+type surgeCell struct {
+	Latitude  int
+	Longitude int
+}
+
+func surgeCellOf(latitude, longitude int) surgeCell {
+	return surgeCell{
+		Latitude:  floorDiv(latitude, surgeCellSize),
+		Longitude: floorDiv(longitude, surgeCellSize),
+	}
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// 倍率は surgeJobWorker がバックグラウンドで計算し直し、ロックは差し替えと読み出しの間だけ取る
+type surgePricing struct {
+	mu          sync.RWMutex
+	multipliers map[surgeCell]int
+}
+
+var surge = &surgePricing{}
+
+// 配車位置の区画の現在の倍率を返す
+func getSurgeMultiplier(latitude, longitude int) int {
+	surge.mu.RLock()
+	defer surge.mu.RUnlock()
+
+	if multiplier, ok := surge.multipliers[surgeCellOf(latitude, longitude)]; ok {
+		return multiplier
+	}
+	return surgeBaseMultiplier
+}
+
+// ctx がキャンセルされるまで一定間隔で区画ごとの倍率を計算し直す
+func surgeJobWorker(ctx context.Context) {
+	ticker := time.NewTicker(surgeRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		multipliers, err := computeSurgeMultipliers(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("failed to compute surge multipliers", slog.Any("error", err))
+			}
+			continue
+		}
+		surge.mu.Lock()
+		surge.multipliers = multipliers
+		surge.mu.Unlock()
+	}
+}
+
+// 区画ごとに、椅子の割り当てを待っているライドの数と空いている椅子の数から倍率を求める
+// 等倍でない区画だけを返す
+func computeSurgeMultipliers(ctx context.Context) (map[surgeCell]int, error) {
+	multipliers := map[surgeCell]int{}
+	// 初期化前は椅子の位置が分からない
+	if cache == nil {
+		return multipliers, nil
+	}
+
+	waitingRides := []Ride{}
+	if err := db.SelectContext(ctx, &waitingRides, `
+		SELECT * FROM rides
+		WHERE chair_id IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status = 'CANCELED')
+	`); err != nil {
+		return nil, err
+	}
+	if len(waitingRides) == 0 {
+		return multipliers, nil
+	}
+	demand := map[surgeCell]int{}
+	for _, ride := range waitingRides {
+		demand[surgeCellOf(ride.PickupLatitude, ride.PickupLongitude)]++
+	}
+
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, `SELECT id FROM chairs WHERE is_active = TRUE`); err != nil {
+		return nil, err
+	}
+	supply := map[surgeCell]int{}
+	for _, chairID := range chairIDs {
+		activeRides, err := cache.activeRides.Get(ctx, chairID)
+		if err != nil {
+			return nil, err
+		}
+		if activeRides.Value != 0 {
+			continue
+		}
+		location, _ := cache.latestChairLocation.Get(ctx, chairID)
+		if !location.Found {
+			continue
+		}
+		supply[surgeCellOf(location.Value.Latitude, location.Value.Longitude)]++
+	}
+
+	for cell, waiting := range demand {
+		if multiplier := calculateSurgeMultiplier(waiting, supply[cell]); multiplier != surgeBaseMultiplier {
+			multipliers[cell] = multiplier
+		}
+	}
+	return multipliers, nil
+}
+
+// 待っているライドが空いている椅子より多い分だけ割り増す
+// 需要が供給の 2 倍で 1.2 倍、5 倍で 2 倍になり、それ以上は上げない
+func calculateSurgeMultiplier(waiting, free int) int {
+	if waiting <= free {
+		return surgeBaseMultiplier
+	}
+	ratio := waiting * surgeBaseMultiplier / max(free, 1)
+	multiplier := surgeBaseMultiplier + (ratio-surgeBaseMultiplier)/4
+	multiplier -= multiplier % surgeMultiplierStep
+	return min(multiplier, surgeMaxMultiplier)
+}
+
+// 距離に応じた運賃に倍率を掛ける。初乗り運賃は割り増さない
+func applySurge(meteredFare, surgeMultiplier int) int {
+	return meteredFare * surgeMultiplier / surgeBaseMultiplier
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 1回に返す位置の数の既定値と上限
+	defaultTrackMaxPoints = 500
+	maxTrackMaxPoints     = 5000
+)
+
+type trackPoint struct {
+	Latitude   int   `json:"latitude"`
+	Longitude  int   `json:"longitude"`
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+type chairTrack struct {
+	// 間引く前の位置の数
+	TotalPoints int          `json:"total_points"`
+	Points      []trackPoint `json:"points"`
+}
+
+func parseTrackMaxPoints(r *http.Request) (int, error) {
+	if r.URL.Query().Get("max_points") == "" {
+		return defaultTrackMaxPoints, nil
+	}
+	maxPoints, err := strconv.Atoi(r.URL.Query().Get("max_points"))
+	if err != nil || maxPoints < 2 || maxPoints > maxTrackMaxPoints {
+		return 0, errors.New("max_points must be between 2 and " + strconv.Itoa(maxTrackMaxPoints))
+	}
+	return maxPoints, nil
+}
+
+// since から until までの椅子の位置を記録順に返す
+// maxPoints を超える場合は等間隔に間引く。最初と最後の位置は必ず残す
+func getChairTrack(ctx context.Context, chairID string, since, until time.Time, maxPoints int) (*chairTrack, error) {
+	total := 0
+	if err := db.GetContext(ctx, &total, "SELECT COUNT(*) FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ?", chairID, since, until); err != nil {
+		return nil, err
+	}
+	track := &chairTrack{TotalPoints: total, Points: []trackPoint{}}
+	if total == 0 {
+		return track, nil
+	}
+
+	// 最後の位置を足しても maxPoints を超えない間隔にする
+	step := 1
+	if total > maxPoints {
+		step = (total-1)/(maxPoints-1) + 1
+	}
+
+	locations := []ChairLocation{}
+	if err := db.SelectContext(
+		ctx,
+		&locations,
+		`SELECT id, chair_id, latitude, longitude, created_at FROM (
+		   SELECT *, ROW_NUMBER() OVER (ORDER BY created_at, id) AS rn
+		   FROM chair_locations
+		   WHERE chair_id = ? AND created_at BETWEEN ? AND ?
+		 ) AS numbered
+		 WHERE MOD(rn - 1, ?) = 0 OR rn = ?
+		 ORDER BY rn`,
+		chairID, since, until, step, total,
+	); err != nil {
+		return nil, err
+	}
+	for _, location := range locations {
+		track.Points = append(track.Points, trackPoint{
+			Latitude:   location.Latitude,
+			Longitude:  location.Longitude,
+			RecordedAt: location.CreatedAt.UnixMilli(),
+		})
+	}
+	return track, nil
+}
+
+type ownerGetChairTrackResponse struct {
+	ChairID string `json:"chair_id"`
+	*chairTrack
+}
+
+func ownerGetChairTrack(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	since, until, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	maxPoints, err := parseTrackMaxPoints(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// 引退した椅子の履歴も見られる
+	owned := false
+	if err := db.GetContext(ctx, &owned, "SELECT EXISTS(SELECT 1 FROM chairs WHERE id = ? AND owner_id = ?)", chairID, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !owned {
+		writeError(w, http.StatusNotFound, errChairNotFound)
+		return
+	}
+
+	track, err := getChairTrack(ctx, chairID, since, until, maxPoints)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerGetChairTrackResponse{
+		ChairID:    chairID,
+		chairTrack: track,
+	})
+}
+
+type appGetRideTrackResponse struct {
+	RideID  string `json:"ride_id"`
+	ChairID string `json:"chair_id,omitempty"`
+	// 椅子が配車位置へ向かった経路 (ENROUTE から PICKUP まで)
+	Pickup *chairTrack `json:"pickup"`
+	// ユーザーを乗せて目的地へ向かった経路 (PICKUP から ARRIVED まで)
+	Carrying *chairTrack `json:"carrying"`
+}
+
+// ライドの経路を区間ごとに返す。まだ終わっていない区間は現在までの経路を返す
+// max_points は区間ごとに適用する
+func appGetRideTrack(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	rideID := r.PathValue("ride_id")
+
+	maxPoints, err := parseTrackMaxPoints(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ride := &Ride{}
+	if err := db.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? AND user_id = ?", rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errRideNotFound)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &appGetRideTrackResponse{
+		RideID:   ride.ID,
+		ChairID:  ride.ChairID.String,
+		Pickup:   &chairTrack{Points: []trackPoint{}},
+		Carrying: &chairTrack{Points: []trackPoint{}},
+	}
+	if !ride.ChairID.Valid {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	statuses := []RideStatus{}
+	if err := db.SelectContext(ctx, &statuses, "SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at", ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 位置は状態が変わる前に記録されるので、区間の終わりは状態が変わった時刻で区切る
+	statusAt := map[string]time.Time{}
+	for _, status := range statuses {
+		statusAt[status.Status] = status.CreatedAt
+	}
+	// 区間が終わる前にライドが終わっていれば、その時刻で区切る。続いている区間は今までにする
+	// 終わったライドの椅子は次のライドを担当しているので、終わりを決めずに読むとそのライドの位置が混ざる
+	rideEndAt, ended := statusAt["CANCELED"]
+	if !ended {
+		rideEndAt, ended = statusAt["COMPLETED"]
+	}
+	if !ended {
+		// 位置の記録日時と比べるので、DB の時刻を使う
+		if err := db.GetContext(ctx, &rideEndAt, "SELECT CURRENT_TIMESTAMP(6)"); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	until := func(status string) time.Time {
+		if t, ok := statusAt[status]; ok {
+			return t
+		}
+		return rideEndAt
+	}
+
+	if enrouteAt, ok := statusAt["ENROUTE"]; ok {
+		res.Pickup, err = getChairTrack(ctx, ride.ChairID.String, enrouteAt, until("PICKUP"), maxPoints)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if pickupAt, ok := statusAt["PICKUP"]; ok {
+		res.Carrying, err = getChairTrack(ctx, ride.ChairID.String, pickupAt, until("ARRIVED"), maxPoints)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
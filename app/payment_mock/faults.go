@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 本番の決済ゲートウェイの不安定さを再現するための設定
+// GET /payments は障害と関係なく成功するので、POST /payments にだけ適用する
+type FaultConfig struct {
+	// 決済を記録せずに 500 を返す割合 (0.0 - 1.0)
+	ErrorRate float64 `json:"error_rate"`
+	// 決済を記録した上で 500 を返す割合 (0.0 - 1.0)
+	SucceedButErrorRate float64 `json:"succeed_but_error_rate"`
+	// 応答までに追加で待つ時間 (ミリ秒)
+	LatencyMs int `json:"latency_ms"`
+	// LatencyMs に加えてランダムに待つ最大時間 (ミリ秒)
+	LatencyJitterMs int `json:"latency_jitter_ms"`
+	// 同時に処理する POST /payments の上限。超えた分は 503 を返す。0 なら無制限
+	MaxConcurrency int `json:"max_concurrency"`
+}
+
+type faultInjector struct {
+	mu       sync.RWMutex
+	config   FaultConfig
+	inFlight atomic.Int64
+}
+
+var faults = &faultInjector{}
+
+func registerFaultFlags(fs *flag.FlagSet, c *FaultConfig) {
+	fs.Float64Var(&c.ErrorRate, "error-rate", 0, "rate of POST /payments that fail with 500 without recording the payment")
+	fs.Float64Var(&c.SucceedButErrorRate, "succeed-but-error-rate", 0, "rate of POST /payments that record the payment but respond 500")
+	fs.IntVar(&c.LatencyMs, "latency-ms", 0, "latency added to POST /payments in milliseconds")
+	fs.IntVar(&c.LatencyJitterMs, "latency-jitter-ms", 0, "random latency added on top of -latency-ms in milliseconds")
+	fs.IntVar(&c.MaxConcurrency, "max-concurrency", 0, "max concurrent POST /payments, 0 means unlimited")
+}
+
+func (f *faultInjector) Config() FaultConfig {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.config
+}
+
+func (f *faultInjector) SetConfig(c FaultConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config = c
+}
+
+func (c FaultConfig) validate() string {
+	if c.ErrorRate < 0 || c.ErrorRate > 1 || c.SucceedButErrorRate < 0 || c.SucceedButErrorRate > 1 {
+		return "error_rate と succeed_but_error_rate は 0 から 1 の範囲で指定してください"
+	}
+	if c.LatencyMs < 0 || c.LatencyJitterMs < 0 || c.MaxConcurrency < 0 {
+		return "latency_ms, latency_jitter_ms, max_concurrency は 0 以上で指定してください"
+	}
+	return ""
+}
+
+// POST /payments に障害を注入する
+// 決済を記録する前の障害はここで応答し、記録した後に 500 を返すかどうかを recordThenFail で返す
+func (f *faultInjector) Wrap(next func(w http.ResponseWriter, r *http.Request, recordThenFail bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := f.Config()
+
+		if c.MaxConcurrency > 0 {
+			n := f.inFlight.Add(1)
+			defer f.inFlight.Add(-1)
+			if n > int64(c.MaxConcurrency) {
+				slog.Warn("同時リクエスト数の上限を超えました", slog.Int64("in_flight", n))
+				writeJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "混雑しています"})
+				return
+			}
+		}
+
+		if latency := c.LatencyMs + randIntN(c.LatencyJitterMs+1); latency > 0 {
+			select {
+			case <-time.After(time.Duration(latency) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if rand.Float64() < c.ErrorRate {
+			slog.Warn("障害を注入しました: 決済せずにエラー")
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "内部エラーが発生しました"})
+			return
+		}
+
+		next(w, r, rand.Float64() < c.SucceedButErrorRate)
+	}
+}
+
+func randIntN(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return rand.IntN(n)
+}
+
+func handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, faults.Config())
+}
+
+// 指定しなかった項目は現在の設定のまま
+func handlePutFaults(w http.ResponseWriter, r *http.Request) {
+	c := faults.Config()
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if msg := c.validate(); msg != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": msg})
+		return
+	}
+	faults.SetConfig(c)
+	slog.Info("障害注入の設定を更新しました", slog.Any("config", c))
+	writeJSON(w, http.StatusOK, c)
+}
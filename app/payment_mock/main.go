@@ -2,22 +2,47 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 )
 
+type payment struct {
+	Amount         int
+	IdempotencyKey string
+	Refunds        []refund
+}
+
+type refund struct {
+	Amount         int
+	IdempotencyKey string
+}
+
 var (
-	data     = map[string][]int{}
+	data     = map[string][]payment{}
 	dataLock sync.Mutex
 )
 
 func main() {
+	var config FaultConfig
+	registerFaultFlags(flag.CommandLine, &config)
+	flag.Parse()
+	if msg := config.validate(); msg != "" {
+		slog.Error(msg)
+		os.Exit(1)
+	}
+	faults.SetConfig(config)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /payments", handleGetPayments)
-	mux.HandleFunc("POST /payments", handlePostPayments)
+	mux.HandleFunc("POST /payments", faults.Wrap(handlePostPayments))
+	mux.HandleFunc("POST /refunds", handlePostRefunds)
+	mux.HandleFunc("GET /admin/faults", handleGetFaults)
+	mux.HandleFunc("PUT /admin/faults", handlePutFaults)
 	http.ListenAndServe(":12345", mux)
 }
 
@@ -25,7 +50,7 @@ type PostPaymentsRequest struct {
 	Amount int `json:"amount"`
 }
 
-func handlePostPayments(w http.ResponseWriter, r *http.Request) {
+func handlePostPayments(w http.ResponseWriter, r *http.Request, recordThenFail bool) {
 	token, err := getTokenFromAuthorizationHeader(r)
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
@@ -43,23 +68,107 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
 	// モックサーバーは任意のトークンを受け付けて、決済を記録する
 	dataLock.Lock()
-	arr, ok := data[token]
-	if !ok {
-		arr = []int{}
-		data[token] = arr
+	// 同じ Idempotency-Key の決済が記録済みなら、新たに記録せずに成功を返す
+	if idempotencyKey != "" {
+		for _, p := range data[token] {
+			if p.IdempotencyKey == idempotencyKey {
+				dataLock.Unlock()
+				slog.Info("決済済み", slog.String("token", token), slog.String("idempotency_key", idempotencyKey))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
 	}
-	arr = append(arr, req.Amount)
+	data[token] = append(data[token], payment{Amount: req.Amount, IdempotencyKey: idempotencyKey})
 	dataLock.Unlock()
 
 	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount))
+	if recordThenFail {
+		slog.Warn("障害を注入しました: 決済した上でエラー")
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "内部エラーが発生しました"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type PostRefundsRequest struct {
+	PaymentIdempotencyKey string `json:"payment_idempotency_key"`
+	Amount                int    `json:"amount"`
+}
+
+func handlePostRefunds(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Idempotency-Key が必要です"})
+		return
+	}
+
+	var req PostRefundsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if req.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が不正です"})
+		return
+	}
+
+	dataLock.Lock()
+	defer dataLock.Unlock()
+
+	payments := data[token]
+	idx := -1
+	for i, p := range payments {
+		if p.IdempotencyKey == req.PaymentIdempotencyKey {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "返金対象の決済が存在しません"})
+		return
+	}
+
+	refunded := 0
+	for _, rf := range payments[idx].Refunds {
+		// 同じ Idempotency-Key の返金が記録済みなら、新たに記録せずに成功を返す
+		if rf.IdempotencyKey == idempotencyKey {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		refunded += rf.Amount
+	}
+	if refunded+req.Amount > payments[idx].Amount {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が決済額を超えています"})
+		return
+	}
+
+	payments[idx].Refunds = append(payments[idx].Refunds, refund{Amount: req.Amount, IdempotencyKey: idempotencyKey})
+
+	slog.Info("返金完了", slog.String("token", token), slog.String("payment_idempotency_key", req.PaymentIdempotencyKey), slog.Int("amount", req.Amount))
 	w.WriteHeader(http.StatusNoContent)
 }
 
 type ResponsePayment struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	Amount         int              `json:"amount"`
+	Status         string           `json:"status"`
+	IdempotencyKey string           `json:"idempotency_key,omitempty"`
+	Refunds        []ResponseRefund `json:"refunds"`
+}
+
+type ResponseRefund struct {
+	Amount         int    `json:"amount"`
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
 func handleGetPayments(w http.ResponseWriter, r *http.Request) {
@@ -70,16 +179,20 @@ func handleGetPayments(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dataLock.Lock()
-	arr, _ := data[token]
-	dataLock.Unlock()
-
-	res := make([]ResponsePayment, 0, len(arr))
-	for _, amount := range arr {
+	res := make([]ResponsePayment, 0, len(data[token]))
+	for _, p := range data[token] {
+		refunds := make([]ResponseRefund, 0, len(p.Refunds))
+		for _, rf := range p.Refunds {
+			refunds = append(refunds, ResponseRefund{Amount: rf.Amount, IdempotencyKey: rf.IdempotencyKey})
+		}
 		res = append(res, ResponsePayment{
-			Amount: amount,
-			Status: "成功",
+			Amount:         p.Amount,
+			Status:         "成功",
+			IdempotencyKey: p.IdempotencyKey,
+			Refunds:        refunds,
 		})
 	}
+	dataLock.Unlock()
 	writeJSON(w, http.StatusOK, res)
 }
 
@@ -46,7 +46,8 @@ CREATE TABLE chair_locations
   latitude   INTEGER     NOT NULL COMMENT '経度',
   longitude  INTEGER     NOT NULL COMMENT '緯度',
   created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
-  PRIMARY KEY (id)
+  PRIMARY KEY (id),
+  INDEX (chair_id, created_at)
 )
   COMMENT = '椅子の現在位置情報テーブル';
 
@@ -103,7 +104,7 @@ CREATE TABLE ride_statuses
 (
   id              VARCHAR(26)                                                                NOT NULL,
   ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
   created_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
   app_sent_at     DATETIME(6)                                                                NULL COMMENT 'ユーザーへの状態通知日時',
   chair_sent_at   DATETIME(6)                                                                NULL COMMENT '椅子への状態通知日時',
@@ -133,7 +134,7 @@ CREATE TABLE coupons
 (
   user_id    VARCHAR(26)  NOT NULL COMMENT '所有しているユーザーのID',
   code       VARCHAR(255) NOT NULL COMMENT 'クーポンコード',
-  discount   INTEGER      NOT NULL COMMENT '割引額',
+  discount   INTEGER      NOT NULL COMMENT '割引額または割引率',
   created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '付与日時',
   used_by    VARCHAR(26)  NULL COMMENT 'クーポンが適用されたライドのID',
   PRIMARY KEY (user_id, code),
@@ -142,3 +143,93 @@ CREATE TABLE coupons
   INDEX (user_id, code, used_by)
 )
   COMMENT 'クーポンテーブル';
+
+DROP TABLE IF EXISTS payment_outbox;
+CREATE TABLE payment_outbox
+(
+  ride_id         VARCHAR(26)                                  NOT NULL COMMENT 'ライドID',
+  user_id         VARCHAR(26)                                  NOT NULL COMMENT 'ユーザーID',
+  amount          INTEGER                                      NOT NULL COMMENT '決済額',
+  status          ENUM ('PENDING', 'SUCCEEDED', 'FAILED')      NOT NULL DEFAULT 'PENDING' COMMENT '決済状態',
+  attempts        INTEGER                                      NOT NULL DEFAULT 0 COMMENT '決済を試みた回数',
+  next_attempt_at DATETIME(6)                                  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次に決済を試みる日時',
+  last_error      TEXT                                         NULL COMMENT '最後に失敗したときのエラー',
+  created_at      DATETIME(6)                                  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)                                  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id),
+  INDEX (status, next_attempt_at)
+)
+  COMMENT = '決済ゲートウェイへの送信待ちテーブル';
+
+DROP TABLE IF EXISTS ride_refunds;
+CREATE TABLE ride_refunds
+(
+  id           VARCHAR(26)                             NOT NULL COMMENT '返金ID',
+  ride_id      VARCHAR(26)                             NOT NULL COMMENT 'ライドID',
+  amount       INTEGER                                 NOT NULL COMMENT '返金額',
+  sale_amount  INTEGER                                 NOT NULL COMMENT '売上から差し引く額 (割引前の運賃に換算した返金額)',
+  reason       TEXT                                    NOT NULL COMMENT '返金理由',
+  request_key  VARCHAR(255)                            NOT NULL COMMENT '返金要求の Idempotency-Key',
+  requested_by VARCHAR(40)                             NOT NULL COMMENT '返金を要求した主体',
+  status       ENUM ('PENDING', 'SUCCEEDED', 'FAILED') NOT NULL DEFAULT 'PENDING' COMMENT '返金状態',
+  created_at   DATETIME(6)                             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '要求日時',
+  updated_at   DATETIME(6)                             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (ride_id, request_key)
+)
+  COMMENT = 'ライドの返金テーブル';
+
+DROP TABLE IF EXISTS coupon_campaigns;
+CREATE TABLE coupon_campaigns
+(
+  code          VARCHAR(255)                                      NOT NULL COMMENT 'クーポンコード',
+  discount      INTEGER                                           NOT NULL COMMENT '割引額または割引率',
+  discount_kind ENUM ('AMOUNT', 'PERCENT', 'WAIVE_INITIAL_FARE') NOT NULL DEFAULT 'AMOUNT' COMMENT '割引の種類',
+  discount_cap  INTEGER                                           NULL COMMENT '割引額の上限',
+  starts_at     DATETIME(6)                                       NULL COMMENT '利用開始日時',
+  expires_at    DATETIME(6)                                       NULL COMMENT '有効期限',
+  created_at    DATETIME(6)                                       NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (code)
+)
+  COMMENT = 'クーポンキャンペーンテーブル';
+
+DROP TABLE IF EXISTS coupon_campaign_targets;
+CREATE TABLE coupon_campaign_targets
+(
+  code    VARCHAR(255) NOT NULL COMMENT 'クーポンコード',
+  user_id VARCHAR(26)  NOT NULL COMMENT '付与対象のユーザーID',
+  PRIMARY KEY (code, user_id)
+)
+  COMMENT = 'クーポンキャンペーンの付与対象テーブル';
+
+DROP TABLE IF EXISTS ledger_entries;
+CREATE TABLE ledger_entries
+(
+  id           BIGINT                                                                                  NOT NULL AUTO_INCREMENT COMMENT '仕訳ID',
+  reference_id VARCHAR(26)                                                                             NOT NULL COMMENT '取引のID (ライドIDまたは返金ID)',
+  ride_id      VARCHAR(26)                                                                             NOT NULL COMMENT 'ライドID',
+  owner_id     VARCHAR(26)                                                                             NOT NULL COMMENT 'オーナーID',
+  chair_id     VARCHAR(26)                                                                             NOT NULL COMMENT '椅子ID',
+  account      ENUM ('USER_CHARGE', 'COUPON_SUBSIDY', 'PLATFORM_COMMISSION', 'OWNER_EARNING', 'REFUND') NOT NULL COMMENT '勘定科目',
+  amount       INTEGER                                                                                 NOT NULL COMMENT '金額。借方を正、貸方を負とし、1つの取引の合計は0になる',
+  created_at   DATETIME(6)                                                                             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '記録日時',
+  PRIMARY KEY (id),
+  UNIQUE (reference_id, account),
+  INDEX (owner_id, created_at),
+  INDEX (ride_id)
+)
+  COMMENT = '売上の台帳テーブル';
+
+DROP TABLE IF EXISTS chair_sales_hourly;
+CREATE TABLE chair_sales_hourly
+(
+  chair_id         VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  bucket_start     DATETIME    NOT NULL COMMENT '集計する時間帯の開始日時',
+  ride_count       INTEGER     NOT NULL DEFAULT 0 COMMENT '完了したライドの数',
+  sales            INTEGER     NOT NULL DEFAULT 0 COMMENT '売上 (返金を差し引いた額)',
+  fare_total       INTEGER     NOT NULL DEFAULT 0 COMMENT 'ユーザーが支払った運賃の合計',
+  evaluation_total INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  busy_ms          BIGINT      NOT NULL DEFAULT 0 COMMENT 'ライドを担当していた時間 (ミリ秒)',
+  PRIMARY KEY (chair_id, bucket_start)
+)
+  COMMENT = '椅子ごと・1時間ごとの売上の集計テーブル';
@@ -4,7 +4,11 @@ SET CHARACTER_SET_CONNECTION = utf8mb4;
 USE isuride;
 
 INSERT INTO settings (name, value)
-VALUES ('payment_gateway_url', 'http://localhost:12345');
+VALUES ('payment_gateway_url', 'http://localhost:12345'),
+       ('invitation_max_uses', '3'),
+       ('invitation_invitee_discount', '1500'),
+       ('invitation_inviter_reward', '1000'),
+       ('commission_rate_permille', '100');
 
 INSERT INTO chair_models (name, speed)
 VALUES ('リラックスシート NEO', 2),
@@ -0,0 +1,92 @@
+SET CHARACTER_SET_CLIENT = utf8mb4;
+SET CHARACTER_SET_CONNECTION = utf8mb4;
+
+USE isuride;
+
+-- 初期データは列順に依存した INSERT なので、既存テーブルへの列追加は初期データ投入後に行う
+
+ALTER TABLE rides
+  ADD COLUMN matched_at DATETIME(6) NULL COMMENT '椅子割り当て日時' AFTER evaluation;
+
+ALTER TABLE coupons
+  ADD COLUMN starts_at  DATETIME(6) NULL COMMENT '利用開始日時' AFTER used_by,
+  ADD COLUMN expires_at DATETIME(6) NULL COMMENT '有効期限' AFTER starts_at;
+
+ALTER TABLE coupons
+  ADD COLUMN discount_kind ENUM ('AMOUNT', 'PERCENT', 'WAIVE_INITIAL_FARE') NOT NULL DEFAULT 'AMOUNT' COMMENT '割引の種類' AFTER expires_at,
+  ADD COLUMN discount_cap  INTEGER NULL COMMENT '割引額の上限' AFTER discount_kind;
+
+ALTER TABLE rides
+  ADD COLUMN surge_multiplier INTEGER NOT NULL DEFAULT 1000 COMMENT '配車要求時点の運賃の倍率 (千分率)' AFTER matched_at;
+
+ALTER TABLE rides
+  ADD COLUMN base_fare    INTEGER NOT NULL DEFAULT 0 COMMENT '初乗り運賃' AFTER surge_multiplier,
+  ADD COLUMN metered_fare INTEGER NOT NULL DEFAULT 0 COMMENT '距離に応じた運賃 (倍率適用後)' AFTER base_fare,
+  ADD COLUMN discount     INTEGER NOT NULL DEFAULT 0 COMMENT 'クーポンによる割引額' AFTER metered_fare,
+  ADD COLUMN fare         INTEGER NOT NULL DEFAULT 0 COMMENT 'ユーザーが支払う運賃' AFTER discount;
+
+-- 既存のライドの運賃の内訳を、アプリの calculateDiscountedFare と同じ計算で埋める
+UPDATE rides
+SET base_fare    = 500,
+    metered_fare = 100 * (ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude)) * surge_multiplier DIV 1000;
+
+UPDATE rides
+  JOIN coupons ON coupons.used_by = rides.id
+SET rides.discount = CASE coupons.discount_kind
+                       WHEN 'PERCENT' THEN LEAST(rides.metered_fare * coupons.discount DIV 100, IFNULL(coupons.discount_cap, rides.metered_fare), rides.metered_fare)
+                       WHEN 'WAIVE_INITIAL_FARE' THEN rides.base_fare
+                       ELSE LEAST(coupons.discount, rides.metered_fare)
+                     END;
+
+UPDATE rides
+SET fare = base_fare + metered_fare - discount;
+
+-- 完了済みの既存のライドを台帳に記録する。アプリの recordRideLedger と同じ仕訳にする
+SET @commission_rate_permille = IFNULL((SELECT CAST(value AS UNSIGNED) FROM settings WHERE name = 'commission_rate_permille'), 100);
+
+INSERT INTO ledger_entries (reference_id, ride_id, owner_id, chair_id, account, amount, created_at)
+SELECT rides.id, rides.id, chairs.owner_id, chairs.id, accounts.account,
+       CASE accounts.account
+         WHEN 'USER_CHARGE' THEN rides.fare
+         WHEN 'COUPON_SUBSIDY' THEN rides.discount
+         WHEN 'PLATFORM_COMMISSION' THEN -((rides.base_fare + rides.metered_fare) * @commission_rate_permille DIV 1000)
+         WHEN 'OWNER_EARNING' THEN -((rides.base_fare + rides.metered_fare) - (rides.base_fare + rides.metered_fare) * @commission_rate_permille DIV 1000)
+       END,
+       ride_statuses.created_at
+FROM rides
+  JOIN chairs ON chairs.id = rides.chair_id
+  JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED'
+  CROSS JOIN (SELECT 'USER_CHARGE' AS account
+              UNION ALL SELECT 'COUPON_SUBSIDY'
+              UNION ALL SELECT 'PLATFORM_COMMISSION'
+              UNION ALL SELECT 'OWNER_EARNING') AS accounts;
+
+-- 完了済みの既存のライドを売上の集計に加える。アプリの recordChairSalesAggregate と同じ集計にする
+INSERT INTO chair_sales_hourly (chair_id, bucket_start, ride_count, sales, fare_total, evaluation_total, busy_ms)
+SELECT rides.chair_id,
+       DATE_FORMAT(ride_statuses.created_at, '%Y-%m-%d %H:00:00'),
+       COUNT(*),
+       SUM(rides.base_fare + rides.metered_fare),
+       SUM(rides.fare),
+       SUM(IFNULL(rides.evaluation, 0)),
+       SUM(GREATEST(TIMESTAMPDIFF(MICROSECOND, COALESCE(rides.matched_at, rides.created_at), ride_statuses.created_at) DIV 1000, 0))
+FROM rides
+  JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED'
+GROUP BY rides.chair_id, DATE_FORMAT(ride_statuses.created_at, '%Y-%m-%d %H:00:00');
+
+ALTER TABLE chairs
+  ADD COLUMN owner_disabled BOOLEAN     NOT NULL DEFAULT FALSE COMMENT 'オーナーが停止させたかどうか' AFTER access_token,
+  ADD COLUMN retired_at     DATETIME(6) NULL COMMENT '引退日時' AFTER owner_disabled;
+
+ALTER TABLE rides
+  ADD COLUMN canceled_at DATETIME(6) NULL COMMENT 'キャンセル日時' AFTER fare;
+
+-- 既存のキャンセル済みのライドに印を付ける。updated_at は変えない
+UPDATE rides
+  JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'CANCELED'
+SET rides.canceled_at = ride_statuses.created_at,
+    rides.updated_at  = rides.updated_at;
+
+-- 受諾期限切れの検知はマッチングのたびに matched_at で絞り込む
+ALTER TABLE rides
+  ADD INDEX (matched_at);
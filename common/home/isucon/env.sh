@@ -5,4 +5,6 @@ ISUCON_DB_PASSWORD="isucon"
 ISUCON_DB_NAME="isuride"
 
 # マッチング間隔（秒）
-ISUCON_MATCHING_INTERVAL=0.5
+# 各ホストの isuride-go がそれぞれのキャッシュでマッチングすると同じ椅子に二重に割り当てるので、既定では無効にする
+# マッチングするホストだけ env.matching.sh で上書きする (s1/home/isucon/env.matching.sh)
+ISUCON_MATCHING_INTERVAL=0
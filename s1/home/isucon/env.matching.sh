@@ -0,0 +1,2 @@
+# マッチングはこのホストの isuride-go だけで行う
+ISUCON_MATCHING_INTERVAL=0.5